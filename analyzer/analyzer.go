@@ -0,0 +1,10 @@
+// Package analyzer provides the analyzer checking the gotemplate
+// go:generate directives so it can be run by other drivers, eg
+// multichecker, as well as by go vet -vettool=$(which gotemplate)
+package analyzer
+
+import "github.com/ncw/gotemplate/internal/gotemplate"
+
+// Analyzer checks the instance specs of the gotemplate go:generate
+// directives in a package and that the files they make are up to date
+var Analyzer = gotemplate.Analyzer
@@ -19,13 +19,6 @@ func swapSort(data []string, i, j int) {
 	data[i], data[j] = data[j], data[i]
 }
 
-func minSort(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // Insertion sort
 func insertionSort(data []string, a, b int) {
 	for i := a + 1; i < b; i++ {
@@ -154,10 +147,10 @@ func doPivotSort(data []string, lo, hi int) (midlo, midhi int) {
 		c--
 	}
 
-	n := minSort(b-a, a-lo)
+	n := minSharedSort(b-a, a-lo)
 	swapRangeSort(data, lo, b-n, n)
 
-	n = minSort(hi-d, d-c)
+	n = minSharedSort(hi-d, d-c)
 	swapRangeSort(data, c, hi-n, n)
 
 	return lo + b - a, hi - (d - c)
@@ -19,13 +19,6 @@ func swapSortF(data []float64, i, j int) {
 	data[i], data[j] = data[j], data[i]
 }
 
-func minSortF(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // Insertion sort
 func insertionSortF(data []float64, a, b int) {
 	for i := a + 1; i < b; i++ {
@@ -154,10 +147,10 @@ func doPivotSortF(data []float64, lo, hi int) (midlo, midhi int) {
 		c--
 	}
 
-	n := minSortF(b-a, a-lo)
+	n := minSharedSort(b-a, a-lo)
 	swapRangeSortF(data, lo, b-n, n)
 
-	n = minSortF(hi-d, d-c)
+	n = minSharedSort(hi-d, d-c)
 	swapRangeSortF(data, c, hi-n, n)
 
 	return lo + b - a, hi - (d - c)
@@ -19,13 +19,6 @@ func swapSortGt(data []string, i, j int) {
 	data[i], data[j] = data[j], data[i]
 }
 
-func minSortGt(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // Insertion sort
 func insertionSortGt(data []string, a, b int) {
 	for i := a + 1; i < b; i++ {
@@ -174,10 +167,10 @@ func doPivotSortGt(data []string, lo, hi int) (midlo, midhi int) {
 		c--
 	}
 
-	n := minSortGt(b-a, a-lo)
+	n := minSharedSort(b-a, a-lo)
 	swapRangeSortGt(data, lo, b-n, n)
 
-	n = minSortGt(hi-d, d-c)
+	n = minSharedSort(hi-d, d-c)
 	swapRangeSortGt(data, c, hi-n, n)
 
 	return lo + b - a, hi - (d - c)
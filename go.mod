@@ -1,11 +1,10 @@
 module github.com/ncw/gotemplate
 
-go 1.17
-
-require golang.org/x/tools v0.1.9
+go 1.22.0
 
 require (
-	golang.org/x/mod v0.5.1 // indirect
-	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	golang.org/x/mod v0.23.0
+	golang.org/x/tools v0.30.0
 )
+
+require golang.org/x/sync v0.11.0 // indirect
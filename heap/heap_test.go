@@ -9,21 +9,26 @@ import (
 	"testing"
 )
 
+// newA makes a different element for each i, ordered by Less as i is
+//
+// template generator A
+func newA(i int) A { return A(i) }
+
 func verify(t *testing.T, h *Heap, i int) {
 	hs := *h
 	n := len(hs)
 	j1 := 2*i + 1
 	j2 := 2*i + 2
 	if j1 < n {
-		if hs[j1] < hs[i] {
-			t.Errorf("heap invariant invalidated [%d] = %d > [%d] = %d", i, hs[i], j1, hs[j1])
+		if Less(hs[j1], hs[i]) {
+			t.Errorf("heap invariant invalidated [%d] = %v > [%d] = %v", i, hs[i], j1, hs[j1])
 			return
 		}
 		verify(t, h, j1)
 	}
 	if j2 < n {
-		if hs[j2] < hs[i] {
-			t.Errorf("heap invariant invalidated [%d] = %d > [%d] = %d", i, hs[i], j1, hs[j2])
+		if Less(hs[j2], hs[i]) {
+			t.Errorf("heap invariant invalidated [%d] = %v > [%d] = %v", i, hs[i], j1, hs[j2])
 			return
 		}
 		verify(t, h, j2)
@@ -33,7 +38,7 @@ func verify(t *testing.T, h *Heap, i int) {
 func TestInit0(t *testing.T) {
 	h := new(Heap)
 	for i := 20; i > 0; i-- {
-		h.Push(0) // all elements are the same
+		h.Push(newA(0)) // all elements are the same
 	}
 	h.Init()
 	verify(t, h, 0)
@@ -41,8 +46,8 @@ func TestInit0(t *testing.T) {
 	for i := 1; len(*h) > 0; i++ {
 		x := h.Pop()
 		verify(t, h, 0)
-		if x != 0 {
-			t.Errorf("%d.th pop got %d; want %d", i, x, 0)
+		if x != newA(0) {
+			t.Errorf("%d.th pop got %v; want %v", i, x, newA(0))
 		}
 	}
 }
@@ -50,7 +55,7 @@ func TestInit0(t *testing.T) {
 func TestInit1(t *testing.T) {
 	h := new(Heap)
 	for i := 20; i > 0; i-- {
-		h.Push(A(i)) // all elements are different
+		h.Push(newA(i)) // all elements are different
 	}
 	h.Init()
 	verify(t, h, 0)
@@ -58,8 +63,8 @@ func TestInit1(t *testing.T) {
 	for i := 1; len(*h) > 0; i++ {
 		x := h.Pop()
 		verify(t, h, 0)
-		if int(x) != i {
-			t.Errorf("%d.th pop got %d; want %d", i, x, i)
+		if x != newA(i) {
+			t.Errorf("%d.th pop got %v; want %v", i, x, newA(i))
 		}
 	}
 }
@@ -69,24 +74,24 @@ func Test(t *testing.T) {
 	verify(t, h, 0)
 
 	for i := 20; i > 10; i-- {
-		h.Push(A(i))
+		h.Push(newA(i))
 	}
 	h.Init()
 	verify(t, h, 0)
 
 	for i := 10; i > 0; i-- {
-		h.Push(A(i))
+		h.Push(newA(i))
 		verify(t, h, 0)
 	}
 
 	for i := 1; len(*h) > 0; i++ {
 		x := h.Pop()
 		if i < 20 {
-			h.Push(A(20 + i))
+			h.Push(newA(20 + i))
 		}
 		verify(t, h, 0)
-		if int(x) != i {
-			t.Errorf("%d.th pop got %d; want %d", i, x, i)
+		if x != newA(i) {
+			t.Errorf("%d.th pop got %v; want %v", i, x, newA(i))
 		}
 	}
 }
@@ -94,15 +99,15 @@ func Test(t *testing.T) {
 func TestRemove0(t *testing.T) {
 	h := new(Heap)
 	for i := 0; i < 10; i++ {
-		h.Push(A(i))
+		h.Push(newA(i))
 	}
 	verify(t, h, 0)
 
 	for len(*h) > 0 {
 		i := len(*h) - 1
 		x := h.Remove(i)
-		if int(x) != i {
-			t.Errorf("Remove(%d) got %d; want %d", i, x, i)
+		if x != newA(i) {
+			t.Errorf("Remove(%d) got %v; want %v", i, x, newA(i))
 		}
 		verify(t, h, 0)
 	}
@@ -111,14 +116,14 @@ func TestRemove0(t *testing.T) {
 func TestRemove1(t *testing.T) {
 	h := new(Heap)
 	for i := 0; i < 10; i++ {
-		h.Push(A(i))
+		h.Push(newA(i))
 	}
 	verify(t, h, 0)
 
 	for i := 0; len(*h) > 0; i++ {
 		x := h.Remove(0)
-		if int(x) != i {
-			t.Errorf("Remove(0) got %d; want %d", x, i)
+		if x != newA(i) {
+			t.Errorf("Remove(0) got %v; want %v", x, newA(i))
 		}
 		verify(t, h, 0)
 	}
@@ -129,13 +134,13 @@ func TestRemove2(t *testing.T) {
 
 	h := new(Heap)
 	for i := 0; i < N; i++ {
-		h.Push(A(i))
+		h.Push(newA(i))
 	}
 	verify(t, h, 0)
 
-	m := make(map[int]bool)
+	m := make(map[A]bool)
 	for len(*h) > 0 {
-		m[int(h.Remove((len(*h)-1)/2))] = true
+		m[h.Remove((len(*h)-1)/2)] = true
 		verify(t, h, 0)
 	}
 
@@ -143,8 +148,8 @@ func TestRemove2(t *testing.T) {
 		t.Errorf("len(m) = %d; want %d", len(m), N)
 	}
 	for i := 0; i < len(m); i++ {
-		if !m[i] {
-			t.Errorf("m[%d] doesn't exist", i)
+		if !m[newA(i)] {
+			t.Errorf("m[%v] doesn't exist", newA(i))
 		}
 	}
 }
@@ -154,7 +159,7 @@ func BenchmarkDup(b *testing.B) {
 	h := make(Heap, n)
 	for i := 0; i < b.N; i++ {
 		for j := 0; j < n; j++ {
-			h.Push(0) // all elements are the same
+			h.Push(newA(0)) // all elements are the same
 		}
 	}
 }
@@ -164,24 +169,20 @@ func TestFix(t *testing.T) {
 	verify(t, h, 0)
 
 	for i := 200; i > 0; i -= 10 {
-		h.Push(A(i))
+		h.Push(newA(i))
 	}
 	verify(t, h, 0)
 
-	if (*h)[0] != 10 {
-		t.Fatalf("Expected head to be 10, was %d", (*h)[0])
+	if (*h)[0] != newA(10) {
+		t.Fatalf("Expected head to be %v, was %v", newA(10), (*h)[0])
 	}
-	(*h)[0] = 210
+	(*h)[0] = newA(210)
 	h.Fix(0)
 	verify(t, h, 0)
 
 	for i := 100; i > 0; i-- {
 		elem := rand.Intn(len(*h))
-		if i&1 == 0 {
-			(*h)[elem] *= 2
-		} else {
-			(*h)[elem] /= 2
-		}
+		(*h)[elem] = newA(rand.Intn(400))
 		h.Fix(elem)
 		verify(t, h, 0)
 	}
@@ -0,0 +1,175 @@
+// Analyzer checking the gotemplate go:generate directives
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Analyzer checks the gotemplate go:generate directives in a package
+var Analyzer = &analysis.Analyzer{
+	Name: "gotemplate",
+	Doc: `check //go:generate gotemplate directives
+
+Checks the instance spec parses, the template package can be found,
+the number of arguments matches the template definition, the
+arguments type check in the package and the generated file exists
+and is up to date.`,
+	Run: runAnalyzer,
+}
+
+// runAnalyzer checks the directives in each file of the package
+func runAnalyzer(pass *analysis.Pass) (interface{}, error) {
+	for _, f := range pass.Files {
+		fileName := pass.Fset.File(f.Pos()).Name()
+		for _, cg := range f.Comments {
+			for _, c := range cg.List {
+				if !strings.HasPrefix(c.Text, "//go:generate ") {
+					continue
+				}
+				line := pass.Fset.Position(c.Pos()).Line
+				args, err := generateArgs(fileName, f.Name.Name, line, c.Text)
+				if err == nil && args != nil {
+					err = checkDirective(pass, fileName, c.Pos(), args)
+				}
+				if err != nil {
+					pass.Reportf(c.Pos(), "%v", err)
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkDirective checks the arguments of a gotemplate directive at
+// pos in fileName, returning the first problem found
+func checkDirective(pass *analysis.Pass, fileName string, pos token.Pos, args []string) error {
+	o, args, err := parseDirectiveFlags(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 && (args[0] == "generate" || args[0] == "describe") {
+		return nil
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("need 2 arguments, package and parameters, but got %d", len(args))
+	}
+	makeTemplate := func() *template {
+		t := newTemplateInPackage(filepath.Dir(fileName), args[0], args[1], pass.Pkg.Name())
+		o.apply(t)
+		t.generatedFrom(fileName, pass.Pkg.Name())
+		return t
+	}
+	return recoverFatal(func() {
+		makeTemplate().checkArgs(pass, pos)
+		makeTemplate().checkInstance()
+	})
+}
+
+// checkArgs checks the template can be found, that it is given the
+// right number of arguments and that they type check in the scope of
+// the file at pos, reporting all the arguments which don't
+//
+// Arguments using a package the file doesn't import are left for
+// goimports to find as when instantiating.
+func (t *template) checkArgs(pass *analysis.Pass, pos token.Pos) {
+	_, templateFilePath := t.findTemplateFile()
+	t.inputFile = templateFilePath
+	_, f := parseFile(templateFilePath, nil)
+	t.findTemplateDefinition(f)
+
+	typeParams := map[string]bool{}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.TYPE {
+			for _, spec := range d.Specs {
+				typeParams[spec.(*ast.TypeSpec).Name.Name] = true
+			}
+		}
+	}
+	var problems diagnostics
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, newDiagnostic(severityError, "argument", token.Position{}, format, args...))
+	}
+	checkArg := func(param, arg string) {
+		if t.usesArgImports(arg) {
+			// The package doesn't import them so only check
+			// they can be found which qualifyArgs has done
+			debugf("Not type checking argument %q for %s", arg, param)
+			return
+		}
+		if expr, err := parser.ParseExpr(arg); err == nil {
+			if name := unknownPackageAt(expr, pass.Pkg, pos); name != "" {
+				debugf("Not type checking argument %q for %s as package %s isn't imported", arg, param, name)
+				return
+			}
+		}
+		tv, err := types.Eval(pass.Fset, pass.Pkg, pos, arg)
+		if err != nil {
+			problemf("Argument %q for %s doesn't type check: %v", arg, param, err)
+		} else if typeParams[param] && !tv.IsType() {
+			problemf("Argument %q for %s is not a type", arg, param)
+		}
+	}
+	for _, param := range t.templateArgs {
+		if arg, ok := t.templateArgsMap[param]; ok {
+			checkArg(param, arg)
+		}
+	}
+	for _, arg := range t.variadicArgs {
+		checkArg(t.variadicParam, arg)
+	}
+	var pkgParams []string
+	for param := range t.pkgArgs {
+		pkgParams = append(pkgParams, param)
+	}
+	sort.Strings(pkgParams)
+	for _, param := range pkgParams {
+		importPath := t.pkgArgs[param]
+		if _, err := build.Default.Import(importPath, t.Dir, build.FindOnly); err != nil {
+			problemf("Package %q for %s not found: %v", importPath, param, err)
+		}
+	}
+	if len(problems) > 0 {
+		fatalf("%v", problems)
+	}
+}
+
+// checkInstance checks the generated file exists and is what the
+// template makes now
+func (t *template) checkInstance() {
+	fileName := filepath.Join(t.Dir, t.outputFileName())
+	current, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		fatalf("%s doesn't exist - run go generate", t.outputFileName())
+	} else if err != nil {
+		fatalf("Failed to read %q: %v", fileName, err)
+	}
+	if t.bundle {
+		// Only the section with the instance in is made by t
+		_, decls := splitInstance(fileName, t.instanceSource())
+		section, found := parseBundle(fileName, current).sections[t.Name]
+		if !found {
+			fatalf("%s isn't in %s - run go generate", t.Name, t.outputFileName())
+		}
+		if section != decls {
+			fatalf("%s in %s is out of date - run go generate", t.Name, t.outputFileName())
+		}
+		return
+	}
+	if !bytes.Equal(t.instanceSource(), current) {
+		fatalf("%s is out of date - run go generate", t.outputFileName())
+	}
+}
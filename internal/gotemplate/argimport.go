@@ -0,0 +1,267 @@
+// Arguments which use packages given by their import paths
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// What the import paths in the arguments are replaced with so they
+// parse, followed by the index of the path
+const importPathPlaceholder = "_gotemplateImport"
+
+// Matches the placeholders for import paths
+var matchImportPathPlaceholder = regexp.MustCompile(importPathPlaceholder + `(\d+)`)
+
+// replaceImportPaths replaces the import paths of the packages used
+// in s, eg "github.com/org/app/model".User, with placeholders so it
+// parses as Go, returning the import paths they stand for
+func replaceImportPaths(s string) (string, []string) {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(s))
+	var sc scanner.Scanner
+	sc.Init(file, []byte(s), nil, 0)
+	var out strings.Builder
+	var importPaths []string
+	last, strOffset, strLit := 0, -1, ""
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.PERIOD && strOffset >= 0 {
+			if importPath, err := strconv.Unquote(strLit); err == nil {
+				out.WriteString(s[last:strOffset])
+				fmt.Fprintf(&out, "%s%d", importPathPlaceholder, len(importPaths))
+				importPaths = append(importPaths, importPath)
+				last = strOffset + len(strLit)
+			}
+		}
+		strOffset = -1
+		if tok == token.STRING {
+			strOffset, strLit = file.Offset(pos), lit
+		}
+	}
+	out.WriteString(s[last:])
+	return out.String(), importPaths
+}
+
+// restoreImportPaths puts the import paths back in place of the
+// placeholders from replaceImportPaths
+func restoreImportPaths(s string, importPaths []string) string {
+	if len(importPaths) == 0 {
+		return s
+	}
+	return matchImportPathPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		i, _ := strconv.Atoi(matchImportPathPlaceholder.FindStringSubmatch(placeholder)[1])
+		return strconv.Quote(importPaths[i])
+	})
+}
+
+// packageName returns the name of the package importPath imported
+// from dir
+func packageName(importPath, dir string) (string, error) {
+	p, err := build.Default.Import(importPath, dir, build.ImportMode(0))
+	if err != nil {
+		return "", err
+	}
+	return p.Name, nil
+}
+
+// qualifyArgs replaces the import paths in the arguments, eg
+// "github.com/org/app/model".User, with names for the packages and
+// records the imports the arguments need in t.argImports
+//
+// The packages are named after themselves unless that clashes with an
+// import of the template file f, of another argument or a name
+// declared in the destination package, when a number is added.  The
+// names given with -import are used as they are.
+func (t *template) qualifyArgs(f *ast.File) {
+	taken := map[string]string{} // import path by name
+	declared := t.destinationNames()
+	for _, spec := range f.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := ""
+		if spec.Name != nil {
+			name = spec.Name.Name
+		} else if name, _ = packageName(importPath, t.Dir); name == "" {
+			name = path.Base(importPath)
+		}
+		if argPath, ok := t.pkgArgs[name]; ok {
+			// The import will be replaced by the argument
+			// package which may be named after itself
+			importPath = argPath
+			if argName, err := packageName(argPath, t.Dir); err == nil {
+				taken[argName] = argPath
+			}
+		}
+		taken[name] = importPath
+	}
+	t.argImports = map[string]string{}
+	var aliases []string
+	for alias := range t.importFlags {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		importPath := t.importFlags[alias]
+		if other, found := taken[alias]; found && other != importPath {
+			fatalf("Can't import %q as %s as the template imports %q as %s", importPath, alias, other, alias)
+		}
+		if pos, found := declared[alias]; found {
+			fatalf("Can't import %q as %s as %s is declared at %s", importPath, alias, alias, pos)
+		}
+		if _, err := packageName(importPath, t.Dir); err != nil {
+			fatalf("Package %q for -import %s not found: %v", importPath, alias, err)
+		}
+		taken[alias] = importPath
+		t.argImports[alias] = importPath
+	}
+
+	// importAs returns the name to use for importPath
+	importAs := func(arg, importPath string) string {
+		for alias, p := range t.argImports {
+			if p == importPath {
+				return alias
+			}
+		}
+		name, err := packageName(importPath, t.Dir)
+		if err != nil {
+			fatalf("Package %q in argument %s not found: %v", importPath, arg, err)
+		}
+		alias := name
+		clashes := func(alias string) bool {
+			_, found := declared[alias]
+			return found || taken[alias] != "" && taken[alias] != importPath
+		}
+		for i := 2; clashes(alias); i++ {
+			alias = fmt.Sprintf("%s%d", name, i)
+		}
+		debugf("Importing %q as %s for argument %s", importPath, alias, arg)
+		taken[alias] = importPath
+		t.argImports[alias] = importPath
+		return alias
+	}
+	qualify := func(arg string) string {
+		src, importPaths := replaceImportPaths(arg)
+		if len(importPaths) == 0 {
+			return arg
+		}
+		expr, err := parser.ParseExpr(src)
+		if err != nil {
+			fatalf("Failed to parse argument %q: %v", arg, err)
+		}
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if matches := matchImportPathPlaceholder.FindStringSubmatch(id.Name); matches != nil {
+					i, _ := strconv.Atoi(matches[1])
+					if importPaths[i] == "" {
+						fatalf("Empty import path in argument %s", arg)
+					}
+					id.Name = importAs(arg, importPaths[i])
+				}
+			}
+			return true
+		})
+		var buf bytes.Buffer
+		if err := format.Node(&buf, token.NewFileSet(), expr); err != nil {
+			fatalf("Failed to format argument %q: %v", arg, err)
+		}
+		return buf.String()
+	}
+	for _, param := range t.templateArgs {
+		if arg, ok := t.templateArgsMap[param]; ok {
+			t.templateArgsMap[param] = qualify(arg)
+		}
+	}
+	variadicArgs := make([]string, len(t.variadicArgs))
+	for i, arg := range t.variadicArgs {
+		variadicArgs[i] = qualify(arg)
+	}
+	t.variadicArgs = variadicArgs
+}
+
+// usesArgImports returns whether the argument arg refers to any of
+// the packages in t.argImports
+func (t *template) usesArgImports(arg string) bool {
+	expr, err := parser.ParseExpr(arg)
+	if err != nil {
+		return false
+	}
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && t.argImports[id.Name] != "" {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// addArgImports adds the imports the arguments need to f
+//
+// They are added explicitly, rather than leaving goimports to guess
+// which package is meant, and any which aren't used are removed when
+// the imports are fixed.
+func (t *template) addArgImports(fset *token.FileSet, f *ast.File) {
+	var aliases []string
+	for alias := range t.argImports {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		importPath := t.argImports[alias]
+		name := alias
+		if pkgName, err := packageName(importPath, t.Dir); err == nil && pkgName == alias && alias == path.Base(importPath) {
+			name = ""
+		}
+		astutil.AddNamedImport(fset, f, name, importPath)
+	}
+}
+
+// withArgImports returns the source of the file src with the imports
+// the arguments need added, so they can be looked up in it
+func (t *template) withArgImports(fileName string, src []byte) []byte {
+	if len(t.argImports) == 0 {
+		return src
+	}
+	fset, f := parseFile(fileName, src)
+	t.addArgImports(fset, f)
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		fatalf("Failed to format %s: %v", fileName, err)
+	}
+	return buf.Bytes()
+}
+
+// argScope returns a position in the file fileName of pkg so the
+// arguments are looked up with its imports or token.NoPos for the
+// package scope if they don't need any
+func (t *template) argScope(pkg *packages.Package, fileName string) token.Pos {
+	if len(t.argImports) == 0 {
+		return token.NoPos
+	}
+	for i, compiledFile := range pkg.CompiledGoFiles {
+		if compiledFile == fileName && i < len(pkg.Syntax) {
+			return pkg.Syntax[i].Pos()
+		}
+	}
+	return token.NoPos
+}
@@ -0,0 +1,278 @@
+// Bundles of instances written into one file
+
+package gotemplate
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// "gotemplate:instance mySet" starting the section of a bundle with
+// the instance in
+var matchBundleSection = regexp.MustCompile(`^//gotemplate:instance (\w+)$`)
+
+// A file with several instances in
+type bundle struct {
+	imports  map[string]bool   // import specs as source, eg `rand "math/rand"`
+	sections map[string]string // the declarations of each instance by name
+}
+
+// importSpec returns the source of an import spec
+func importSpec(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name + " " + spec.Path.Value
+	}
+	return spec.Path.Value
+}
+
+// splitInstance returns the imports and the declarations of the
+// source of a file
+func splitInstance(fileName string, src []byte) (specs []string, decls string) {
+	fset, f := parseFile(fileName, src)
+	end := f.Name.End()
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			end = d.End()
+		}
+	}
+	for _, spec := range f.Imports {
+		specs = append(specs, importSpec(spec))
+	}
+	return specs, strings.TrimSpace(string(src[fset.Position(end).Offset:]))
+}
+
+// parseBundle splits the source of a bundle into its sections
+//
+// Anything before the first section is dropped so a file which isn't
+// a bundle yet becomes an empty one.
+func parseBundle(fileName string, src []byte) *bundle {
+	b := &bundle{imports: map[string]bool{}, sections: map[string]string{}}
+	fset, f := parseFile(fileName, src)
+	for _, spec := range f.Imports {
+		b.imports[importSpec(spec)] = true
+	}
+	var starts []*ast.Comment
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matchBundleSection.MatchString(c.Text) {
+				starts = append(starts, c)
+			}
+		}
+	}
+	for i, c := range starts {
+		name := matchBundleSection.FindStringSubmatch(c.Text)[1]
+		from := fset.Position(c.End()).Offset
+		to := len(src)
+		if i+1 < len(starts) {
+			to = fset.Position(starts[i+1].Pos()).Offset
+		}
+		b.sections[name] = strings.TrimSpace(string(src[from:to]))
+	}
+	return b
+}
+
+// readBundle reads the bundle in fileName, returning an empty one if
+// it doesn't exist
+func readBundle(fileName string) *bundle {
+	src, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return parseBundle(fileName, []byte("package p\n"))
+	} else if err != nil {
+		fatalf("Cannot read bundle: %v", err)
+	}
+	return parseBundle(fileName, src)
+}
+
+// add puts the instance called name with the source src in the
+// bundle, replacing any it had already
+func (b *bundle) add(fileName, name string, src []byte) {
+	specs, decls := splitInstance(fileName, src)
+	for _, spec := range specs {
+		b.imports[spec] = true
+	}
+	b.sections[name] = decls
+}
+
+// source returns the source of the bundle for the package pkgName
+//
+// The sections are in order of name and the imports of all of them
+// are merged, so it only depends on what is in the bundle.
+func (b *bundle) source(fileName, pkgName string) []byte {
+	if len(b.sections) == 0 {
+		return []byte("package " + pkgName + "\n")
+	}
+	var specs []string
+	byName := map[string]string{}
+	for spec := range b.imports {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		name, importPath := "", spec
+		if i := strings.Index(spec, " "); i >= 0 {
+			name, importPath = spec[:i], spec[i+1:]
+		}
+		importPath, _ = strconv.Unquote(importPath)
+		if name == "" {
+			name = path.Base(importPath)
+		}
+		if other, found := byName[name]; found && other != importPath && name != "_" && name != "." {
+			fatalf("Instances in %s import both %q and %q as %s", filepath.Base(fileName), other, importPath, name)
+		}
+		byName[name] = importPath
+	}
+	var names []string
+	for name := range b.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	render := func(specs []string) []byte {
+		out := new(bytes.Buffer)
+		out.WriteString(genHeader)
+		out.WriteString("package " + pkgName + "\n\n")
+		switch len(specs) {
+		case 0:
+		case 1:
+			out.WriteString("import " + specs[0] + "\n\n")
+		default:
+			out.WriteString("import (\n")
+			for _, spec := range specs {
+				out.WriteString("\t" + spec + "\n")
+			}
+			out.WriteString(")\n\n")
+		}
+		for _, name := range names {
+			out.WriteString("//gotemplate:instance " + name + "\n\n")
+			out.WriteString(b.sections[name])
+			out.WriteString("\n\n")
+		}
+		// This removes the imports no longer used
+		src, err := imports.Process(fileName, out.Bytes(), nil)
+		if err != nil {
+			fatalf("Cannot fix imports: %v", err)
+		}
+		return src
+	}
+	src := render(specs)
+	// Render again with the imports which are left so they are laid
+	// out as gofmt would
+	_, f := parseFile(fileName, src)
+	var used []string
+	for _, spec := range f.Imports {
+		used = append(used, importSpec(spec))
+	}
+	if len(used) == len(specs) {
+		return src
+	}
+	return render(used)
+}
+
+// sectionDecls returns the top level declarations in the section of
+// the bundle f for the instance called name
+func sectionDecls(f *ast.File, name string) (decls []ast.Decl) {
+	var from, to token.Pos
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			matches := matchBundleSection.FindStringSubmatch(c.Text)
+			if matches == nil {
+				continue
+			}
+			if from.IsValid() && !to.IsValid() {
+				to = c.Pos()
+			}
+			if matches[1] == name {
+				from = c.End()
+			}
+		}
+	}
+	for _, decl := range instanceDecls(f) {
+		if from.IsValid() && decl.Pos() > from && (!to.IsValid() || decl.Pos() < to) {
+			decls = append(decls, decl)
+		}
+	}
+	return decls
+}
+
+// bundleMembers returns the names of the instances which should be
+// in the bundle, from the config file or the go:generate directives
+// in the file t.bundleFrom, or nil if they aren't known
+func (t *template) bundleMembers() map[string]bool {
+	if t.bundleInstances != nil {
+		return t.bundleInstances
+	}
+	if t.bundleFrom == "" {
+		return nil
+	}
+	src, err := ioutil.ReadFile(t.bundleFrom)
+	if err != nil {
+		debugf("Not pruning bundle: %v", err)
+		return nil
+	}
+	members := map[string]bool{}
+	for i, line := range strings.Split(string(src), "\n") {
+		if !strings.HasPrefix(line, "//go:generate ") {
+			continue
+		}
+		args, err := generateArgs(t.bundleFrom, t.NewPackage, i+1, line)
+		if err != nil || args == nil {
+			continue
+		}
+		o, args, err := parseDirectiveFlags(args)
+		if err != nil || !o.bundle || len(args) != 2 {
+			continue
+		}
+		if i := strings.Index(args[1], "("); i > 0 {
+			members[strings.TrimSpace(args[1][:i])] = true
+		}
+	}
+	return members
+}
+
+// bundleWithout returns the source of the bundle in fileName without
+// the instance, as it was when the batch started if it is part of
+// one
+func (t *template) bundleWithout(fileName string) []byte {
+	var b *bundle
+	if src, ok := t.overlay[fileName]; ok {
+		b = parseBundle(fileName, src)
+	} else {
+		b = readBundle(fileName)
+	}
+	delete(b.sections, t.Name)
+	return b.source(fileName, t.NewPackage)
+}
+
+// writeBundle puts the instance with the source src into the bundle
+// in fileName, dropping the instances which are no longer made from
+// the same directives or config, returning the source of the bundle
+func (t *template) writeBundle(fileName string, src []byte) []byte {
+	defer lockPath(fileName)()
+	b := readBundle(fileName)
+	if members := t.bundleMembers(); members != nil {
+		for name := range b.sections {
+			if !members[name] {
+				debugf("Removing %s from bundle %s", name, fileName)
+				delete(b.sections, name)
+			}
+		}
+	}
+	b.add(fileName, t.Name, src)
+	bundleSrc := b.source(fileName, t.NewPackage)
+	if t.typeCheck {
+		t.checkTypes(bundleSrc)
+	}
+	writeFile(fileName, bundleSrc)
+	return bundleSrc
+}
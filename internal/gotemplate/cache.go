@@ -0,0 +1,130 @@
+// Cache of the results of instantiating templates
+
+package gotemplate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+)
+
+// cacheDir returns the directory the cache is kept in
+func cacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		fatalf("Can't find cache directory: %v", err)
+	}
+	return filepath.Join(dir, "gotemplate")
+}
+
+// gotemplateVersion returns a string identifying this build of
+// gotemplate so the cache is invalidated when it changes
+func gotemplateVersion() string {
+	version := develVersion
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version + " " + info.Main.Sum
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				version += " " + setting.Value
+			}
+		}
+	}
+	// Development builds may not have any version info so use the
+	// executable too
+	if executable, err := os.Executable(); err == nil {
+		if info, err := os.Stat(executable); err == nil {
+			version += fmt.Sprintf(" %d %d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return version
+}
+
+// cacheKey returns the key for the result of instantiating the
+// template package p
+//
+// This covers everything which affects the output, including the
+// names and imports declared by the rest of the destination package
+// as the names for the arguments' imports avoid them.
+func (t *template) cacheKey(p *build.Package) string {
+	var destNames []string
+	for name := range t.destinationNames() {
+		destNames = append(destNames, name)
+	}
+	sort.Strings(destNames)
+	var destImports []string
+	for spec := range t.destImports {
+		destImports = append(destImports, spec)
+	}
+	sort.Strings(destImports)
+	var renames []string
+	for from, to := range t.naming.renames {
+		renames = append(renames, from+"="+to)
+	}
+	sort.Strings(renames)
+	var importFlags []string
+	for alias, importPath := range t.importFlags {
+		importFlags = append(importFlags, alias+"="+importPath)
+	}
+	sort.Strings(importFlags)
+	h := sha256.New()
+	fmt.Fprintf(h, "gotemplate %s\n", gotemplateVersion())
+	fmt.Fprintf(h, "template %q %s\n", t.Package, templateHash(p))
+	fmt.Fprintf(h, "instance %q %q %q\n", t.Name, t.Args, importFlags)
+	fmt.Fprintf(h, "package %q\n", t.NewPackage)
+	fmt.Fprintf(h, "destination %q %q %q\n", t.Dir, destNames, destImports)
+	fmt.Fprintf(h, "output %q\n", t.outputFileName())
+	if t.lineDirectives {
+		// The directives have the path from the instance to the template
+		fmt.Fprintf(h, "line directives %q %q\n", t.Dir, p.Dir)
+	}
+	fmt.Fprintf(h, "naming %v %q %q %q\n", t.naming.prefix, t.naming.export, renames, t.collisionSuffix)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readCache returns the cached output for key if there is one
+func readCache(key string) ([]byte, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(cacheDir(), key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("Ignoring cache: %v", err)
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+// writeCache stores the output for key in the cache
+//
+// Failing to write the cache isn't fatal
+func writeCache(key string, b []byte) {
+	dir := cacheDir()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		logf("Failed to make cache directory: %v", err)
+		return
+	}
+	// Write to a temporary file then rename so readers never see
+	// a partial entry
+	f, err := ioutil.TempFile(dir, key+".tmp")
+	if err != nil {
+		logf("Failed to write cache: %v", err)
+		return
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, key))
+	}
+	if err != nil {
+		logf("Failed to write cache: %v", err)
+		_ = os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,94 @@
+// Type checking the instance in the destination package
+
+package gotemplate
+
+import (
+	"fmt"
+	"go/token"
+	"path/filepath"
+)
+
+// Severity of the diagnostics which don't stop the instance being
+// written
+const severityWarning = "warning"
+
+// templateLines makes the map from the lines of the instance in src
+// to the lines of the template they came from
+func (t *template) templateLines(fileName string, src []byte) *instanceMap {
+	fset, f := parseFile(fileName, src)
+	decls := instanceDecls(f)
+	if t.bundle {
+		decls = sectionDecls(f, t.Name)
+	}
+	if len(decls) != len(t.declPositions) {
+		fatalf("Internal error: found %d declarations in the instance but expecting %d", len(decls), len(t.declPositions))
+	}
+	m := &instanceMap{templateFile: t.inputFile}
+	for i, decl := range decls {
+		m.decls = append(m.decls, declMap{
+			// Not adjusted by any //line comments
+			line:         fset.PositionFor(decl.Pos(), false).Line,
+			templateLine: t.declPositions[i].Line,
+		})
+	}
+	return m
+}
+
+// typeCheckInstance type checks the destination package with src as
+// the instance, returning the errors in the instance along with the
+// line of the template responsible for each if the template has been
+// parsed
+func (t *template) typeCheckInstance(src []byte) diagnostics {
+	fileName := filepath.Join(t.Dir, t.outputFileName())
+	overlay := map[string][]byte{}
+	for overlayFile, b := range t.overlay {
+		overlay[overlayFile] = b
+	}
+	overlay[fileName] = src
+	pkg := t.loadDestination(overlay)
+
+	var m *instanceMap
+	if t.declPositions != nil {
+		m = t.templateLines(fileName, src)
+	}
+	var problems diagnostics
+	for _, err := range pkg.TypeErrors {
+		// Errors in the rest of the package aren't our problem
+		pos := err.Fset.PositionFor(err.Pos, false)
+		if pos.Filename != fileName {
+			continue
+		}
+		msg := err.Msg
+		if m != nil {
+			from := token.Position{Filename: m.templateFile, Line: m.position(pos.Line, pos.Column).line}
+			msg = fmt.Sprintf("%s (from template %s)", msg, from)
+		}
+		d := newDiagnostic(severityError, "check", pos, "%s", msg)
+		// The file on disk isn't the new instance
+		d.Context = sourceLine(src, pos.Line)
+		problems = append(problems, d)
+	}
+	return problems
+}
+
+// checkTypes type checks the instance in src, refusing to write it
+// if it doesn't compile unless forced
+func (t *template) checkTypes(src []byte) {
+	problems := t.typeCheckInstance(src)
+	if len(problems) == 0 {
+		return
+	}
+	if !t.force {
+		fatalf("Found %d errors type checking %s in package %s - use -force to write it anyway\n%v", len(problems), t.spec(), t.NewPackage, problems)
+	}
+	for i := range problems {
+		problems[i].Severity = severityWarning
+	}
+	if *jsonOutput {
+		for _, d := range problems {
+			emit(d)
+		}
+	} else {
+		logf("Writing %s with %d errors because of -force\n%v", t.outputFileName(), len(problems), problems)
+	}
+}
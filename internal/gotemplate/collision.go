@@ -0,0 +1,240 @@
+// Detects clashes between the names given to the instance and the
+// rest of the destination package
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A top level name declared by the instance
+type instanceName struct {
+	obj    types.Object // object in the template
+	name   string       // may contain the placeholders for repeats
+	shared bool         // set if it is going in the shared file
+}
+
+// topLevelIdents returns the identifiers of the names declared in
+// the package scope by f
+func topLevelIdents(f *ast.File) []*ast.Ident {
+	var idents []*ast.Ident
+	add := func(id *ast.Ident) {
+		if id.Name != "_" {
+			idents = append(idents, id)
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil && d.Name.Name != "init" {
+				add(d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name)
+				case *ast.ValueSpec:
+					for _, id := range s.Names {
+						add(id)
+					}
+				}
+			}
+		}
+	}
+	return idents
+}
+
+// instanceNames returns the top level names the instance declares
+func instanceNames(f *ast.File, info *types.Info, sharedDecls []*ast.FuncDecl) []instanceName {
+	var names []instanceName
+	for _, id := range topLevelIdents(f) {
+		names = append(names, instanceName{obj: info.Defs[id], name: id.Name})
+	}
+	for _, d := range sharedDecls {
+		if d.Name.Name != "_" {
+			names = append(names, instanceName{obj: info.Defs[d.Name], name: d.Name.Name, shared: true})
+		}
+	}
+	return names
+}
+
+// expandName returns the names name will become in the output once
+// any repeats are expanded
+func (t *template) expandName(name string) []string {
+	if !hasRepeatPlaceholder(name) {
+		return []string{name}
+	}
+	var names []string
+	for i, arg := range t.variadicArgs {
+		names = append(names, t.repeatReplacer(i, arg).Replace(name))
+	}
+	return names
+}
+
+// destinationNames returns the positions of the top level names
+// declared in the destination package, excluding the file being
+// regenerated or, in a bundle, its section.
+//
+// Only the names are needed so the files are parsed rather than
+// loading and type checking the package.
+func (t *template) destinationNames() map[string]token.Position {
+	if t.destNames != nil {
+		return t.destNames
+	}
+	outputFile := filepath.Join(t.Dir, t.outputFileName())
+	// Read the files in the overlay from it as other instances may
+	// be writing them
+	ctxt := build.Default
+	ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+		if b, ok := t.overlay[path]; ok {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		return os.Open(path)
+	}
+	p, err := ctxt.ImportDir(t.Dir, build.ImportMode(0))
+	if _, noGo := err.(*build.NoGoError); err != nil && !noGo {
+		fatalf("Failed to read package in %q: %v", t.Dir, err)
+	}
+	var fileNames []string
+	if strings.HasSuffix(t.NewPackage, "_test") && t.NewPackage != p.Name {
+		fileNames = p.XTestGoFiles
+	} else {
+		fileNames = append(append(fileNames, p.GoFiles...), p.CgoFiles...)
+		if t.testOutput {
+			fileNames = append(fileNames, p.TestGoFiles...)
+		}
+	}
+	sources := map[string]interface{}{}
+	for _, fileName := range fileNames {
+		sources[filepath.Join(t.Dir, fileName)] = nil
+	}
+	// Instances being generated at the same time may not be
+	// written yet
+	for fileName, b := range t.overlay {
+		_, listed := sources[fileName]
+		inDir := filepath.Dir(fileName) == filepath.Clean(t.Dir) && strings.HasSuffix(fileName, ".go")
+		if listed || inDir && (t.testOutput || !strings.HasSuffix(fileName, "_test.go")) {
+			sources[fileName] = b
+		}
+	}
+	delete(sources, outputFile)
+	if t.bundle {
+		sources[outputFile] = t.bundleWithout(outputFile)
+	}
+
+	fset := token.NewFileSet()
+	t.destNames = map[string]token.Position{}
+	t.destImports = map[string]bool{}
+	for fileName, src := range sources {
+		f, err := parser.ParseFile(fset, fileName, src, parser.SkipObjectResolution)
+		if err != nil {
+			fatalf("Failed to parse %q: %v", fileName, err)
+		}
+		if f.Name.Name != t.NewPackage {
+			continue
+		}
+		for _, id := range topLevelIdents(f) {
+			t.destNames[id.Name] = fset.Position(id.Pos())
+		}
+		for _, spec := range f.Imports {
+			name := ""
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			t.destImports[name+" "+spec.Path.Value] = true
+		}
+	}
+	return t.destNames
+}
+
+// checkCachedCollisions makes sure the top level names of the cached
+// instance b aren't declared in the rest of the destination package
+func (t *template) checkCachedCollisions(b []byte) {
+	destNames := t.destinationNames()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, t.outputFileName(), b, parser.SkipObjectResolution)
+	if err != nil {
+		fatalf("Failed to parse cached instance: %v", err)
+	}
+	var problems diagnostics
+	for _, id := range topLevelIdents(f) {
+		if position, ok := destNames[id.Name]; ok {
+			problems = append(problems, newDiagnostic(severityError, "collision", fset.Position(id.Pos()), "%s collides with the declaration at %s", id.Name, position))
+		}
+	}
+	if len(problems) > 0 {
+		fatalf("Found %d name collisions instantiating %s - use -rename or -collision-suffix to avoid them\n%v", len(problems), t.spec(), problems)
+	}
+}
+
+// checkCollisions makes sure the top level names of the instance
+// aren't already declared in the destination package, excluding the
+// file being regenerated, or more than once in the instance itself.
+//
+// A colliding name has the -collision-suffix appended if there is
+// one, otherwise all the collisions are reported and it is a fatal
+// error.
+func (t *template) checkCollisions(fset *token.FileSet, f *ast.File, info *types.Info, sharedDecls []*ast.FuncDecl) {
+	destNames := t.destinationNames()
+	sharedFile := sharedFileName(t.templateName)
+	declared := map[string]types.Object{}
+
+	// collision describes what name collides with or returns "" if
+	// it doesn't
+	collision := func(n instanceName, name string) string {
+		if position, ok := destNames[name]; ok {
+			// The shared helpers are expected to be there already
+			if !n.shared || filepath.Base(position.Filename) != sharedFile {
+				return fmt.Sprintf("%s collides with the declaration at %s", name, position)
+			}
+		}
+		if other := declared[name]; other != nil && other != n.obj {
+			return fmt.Sprintf("%s collides with the template declaration at %s", name, fset.Position(other.Pos()))
+		}
+		return ""
+	}
+	collisions := func(n instanceName) (found []string) {
+		for _, name := range t.expandName(n.name) {
+			if c := collision(n, name); c != "" {
+				found = append(found, c)
+			}
+		}
+		return found
+	}
+
+	var problems diagnostics
+	for _, n := range instanceNames(f, info, sharedDecls) {
+		found := collisions(n)
+		if len(found) > 0 && t.collisionSuffix != "" {
+			renamed := n
+			renamed.name += t.collisionSuffix
+			if collisions(renamed) == nil {
+				debugf("Renaming %s to %s to avoid %s", n.name, renamed.name, found[0])
+				replaceIdentifier(f, info, n.obj, renamed.name)
+				t.usesDestination = true
+				n, found = renamed, nil
+			}
+		}
+		for _, c := range found {
+			problems = append(problems, newDiagnostic(severityError, "collision", fset.Position(n.obj.Pos()), "%s", c))
+		}
+		for _, name := range t.expandName(n.name) {
+			declared[name] = n.obj
+		}
+	}
+	if len(problems) > 0 {
+		fatalf("Found %d name collisions instantiating %s - use -rename or -collision-suffix to avoid them\n%v", len(problems), t.spec(), problems)
+	}
+}
@@ -0,0 +1,448 @@
+// Conditional sections of templates which depend on the arguments
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// "template if comparable(A)", "template else", "template end"
+var matchTemplateConditional = regexp.MustCompile(`^//\s*template\s+(if|else|end)\b\s*(.*?)\s*$`)
+
+// Predicates which can be used in conditions on type parameters
+var typePredicates = map[string]func(types.Type) bool{
+	"comparable": types.Comparable,
+	"ordered":    basicInfo(types.IsOrdered),
+	"integer":    basicInfo(types.IsInteger),
+	"unsigned":   basicInfo(types.IsUnsigned),
+	"float":      basicInfo(types.IsFloat),
+	"numeric":    basicInfo(types.IsNumeric),
+	"string":     basicInfo(types.IsString),
+	"bool":       basicInfo(types.IsBoolean),
+}
+
+// basicInfo makes a predicate which checks the underlying type is a
+// basic type with info set
+func basicInfo(info types.BasicInfo) func(types.Type) bool {
+	return func(typ types.Type) bool {
+		basic, ok := typ.Underlying().(*types.Basic)
+		return ok && basic.Info()&info != 0
+	}
+}
+
+// A "template if" which is being processed
+type conditional struct {
+	cond   bool // value of the condition
+	inElse bool // set if we've seen the "template else"
+}
+
+// destPackage type checks the package the template is being
+// instantiated into so the arguments can be looked up in it
+//
+// The package is loaded once without the file being regenerated and
+// errors in it are ignored as it may well need the instance before it
+// compiles.
+func (t *template) destPackage() *packages.Package {
+	if t.destPkg != nil {
+		return t.destPkg
+	}
+	overlay := map[string][]byte{}
+	for fileName, b := range t.overlay {
+		overlay[fileName] = b
+	}
+	fileName := filepath.Join(t.Dir, t.outputFileName())
+	if t.bundle {
+		overlay[fileName] = t.bundleWithout(fileName)
+	} else {
+		overlay[fileName] = []byte("package " + t.NewPackage + "\n")
+	}
+	// So the arguments can use the packages they import
+	overlay[fileName] = t.withArgImports(fileName, overlay[fileName])
+	t.destPkg = t.loadDestination(overlay)
+	return t.destPkg
+}
+
+// loadDestination type checks the package the instance is written to
+// with the overlay
+//
+// If the instance is in a test file then this is the test package it
+// is part of, which may be an external test package.
+func (t *template) loadDestination(overlay map[string][]byte) *packages.Package {
+	conf := &packages.Config{
+		Dir:     t.Dir,
+		Overlay: overlay,
+		Tests:   t.testOutput,
+	}
+	pkgs, err := loadPackages(conf, ".")
+	if err != nil {
+		fatalf("Failed to load package in %q: %v", t.Dir, err)
+	}
+	fileName := filepath.Join(t.Dir, t.outputFileName())
+	for _, pkg := range pkgs {
+		if pkg.Types == nil {
+			continue
+		}
+		for _, compiledFile := range pkg.CompiledGoFiles {
+			if compiledFile == fileName {
+				return pkg
+			}
+		}
+	}
+	fatalf("Failed to load package in %q", t.Dir)
+	return nil
+}
+
+// evalArg type checks the argument arg for the template parameter
+// param in the destination package, recording any problem in
+// t.argErrors and returning false
+func (t *template) evalArg(param, arg string) (types.TypeAndValue, bool) {
+	pkg := t.destPackage()
+	pos := t.argScope(pkg, filepath.Join(t.Dir, t.outputFileName()))
+	tv, err := types.Eval(pkg.Fset, pkg.Types, pos, arg)
+	if err != nil {
+		t.argErrors = append(t.argErrors, newDiagnostic(severityError, "argument", token.Position{}, "Failed to type check argument %q for %s: %v", arg, param, err))
+		return tv, false
+	}
+	return tv, true
+}
+
+// unknownPackage returns the name of a package arg uses which isn't
+// imported where it is type checked, which goimports will look for
+// when the instance is written, or "" if there isn't one
+func (t *template) unknownPackage(arg string) string {
+	expr, err := parser.ParseExpr(arg)
+	if err != nil {
+		return ""
+	}
+	pkg := t.destPackage()
+	pos := t.argScope(pkg, filepath.Join(t.Dir, t.outputFileName()))
+	return unknownPackageAt(expr, pkg.Types, pos)
+}
+
+// unknownPackageAt returns the name of a package expr uses which
+// isn't visible at pos in pkg, or "" if there isn't one
+func unknownPackageAt(expr ast.Expr, pkg *types.Package, pos token.Pos) string {
+	scope := pkg.Scope()
+	if pos.IsValid() {
+		scope = scope.Innermost(pos)
+	}
+	unknown := ""
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && unknown == "" {
+				if _, obj := scope.LookupParent(id.Name, pos); obj == nil {
+					unknown = id.Name
+				}
+			}
+		}
+		return unknown == ""
+	})
+	return unknown
+}
+
+// typeCheckArgs type checks all the arguments in the destination
+// package before anything is instantiated, recording the problems in
+// t.argErrors so they can all be reported together
+//
+// The arguments for the types declared by the template file f must
+// be types.  Variadic arguments are only checked for a type as
+// otherwise they may just be names.
+func (t *template) typeCheckArgs(f *ast.File) {
+	typeParams := map[string]bool{}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.TYPE {
+			for _, spec := range d.Specs {
+				typeParams[spec.(*ast.TypeSpec).Name.Name] = true
+			}
+		}
+	}
+	if t.argTypes == nil {
+		t.argTypes = map[string]types.Type{}
+	}
+	check := func(param, arg string) types.Type {
+		if name := t.unknownPackage(arg); name != "" {
+			debugf("Not type checking argument %q for %s as package %s isn't imported", arg, param, name)
+			return nil
+		}
+		tv, ok := t.evalArg(param, arg)
+		if !ok {
+			return types.Typ[types.Invalid]
+		}
+		if !tv.IsType() {
+			if typeParams[param] {
+				t.argErrors = append(t.argErrors, newDiagnostic(severityError, "argument", token.Position{}, "Argument %q for %s is not a type", arg, param))
+				return types.Typ[types.Invalid]
+			}
+			return nil
+		}
+		return tv.Type
+	}
+	for _, param := range t.templateArgs {
+		if arg, ok := t.templateArgsMap[param]; ok {
+			if typ := check(param, arg); typ != nil {
+				t.argTypes[param] = typ
+			}
+		}
+	}
+	if typeParams[t.variadicParam] {
+		for _, arg := range t.variadicArgs {
+			check(t.variadicParam, arg)
+		}
+	}
+}
+
+// argType returns the type of the argument for the template
+// parameter called name
+//
+// Problems with the argument are recorded in t.argErrors so they can
+// all be reported together, returning an invalid type.
+func (t *template) argType(name string) types.Type {
+	arg, ok := t.templateArgsMap[name]
+	if !ok {
+		fatalf("Unknown template parameter %q in condition", name)
+	}
+	t.usesDestination = true
+	if typ, ok := t.argTypes[name]; ok {
+		return typ
+	}
+	var typ types.Type = types.Typ[types.Invalid]
+	if tv, ok := t.evalArg(name, arg); ok {
+		if !tv.IsType() {
+			t.argErrors = append(t.argErrors, newDiagnostic(severityError, "argument", token.Position{}, "Argument %q for %s is not a type", arg, name))
+		} else {
+			typ = tv.Type
+		}
+	}
+	if t.argTypes == nil {
+		t.argTypes = map[string]types.Type{}
+	}
+	t.argTypes[name] = typ
+	return typ
+}
+
+// evalCondition evaluates the condition expression from a "template
+// if"
+func (t *template) evalCondition(s string, expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return t.evalCondition(s, e.X)
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			return !t.evalCondition(s, e.X)
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND:
+			return t.evalCondition(s, e.X) && t.evalCondition(s, e.Y)
+		case token.LOR:
+			return t.evalCondition(s, e.X) || t.evalCondition(s, e.Y)
+		}
+	case *ast.CallExpr:
+		fn, ok := e.Fun.(*ast.Ident)
+		if !ok || len(e.Args) != 1 {
+			break
+		}
+		predicate, ok := typePredicates[fn.Name]
+		if !ok {
+			fatalf("Unknown predicate %q in condition %q", fn.Name, s)
+		}
+		param, ok := e.Args[0].(*ast.Ident)
+		if !ok {
+			fatalf("Expecting a template parameter in condition %q", s)
+		}
+		result := predicate(t.argType(param.Name))
+		debugf("Condition %s(%s) is %v", fn.Name, param.Name, result)
+		return result
+	}
+	fatalf("Failed to parse condition %q: expecting predicate(Param) combined with !, && and ||", s)
+	return false
+}
+
+// A range of source which isn't being instantiated
+type posRange struct {
+	from, to token.Pos
+}
+
+// findConditionals returns the "template if", "else" and "end"
+// directives in f and the ranges of the source in the branches not
+// taken
+func (t *template) findConditionals(f *ast.File) (map[*ast.Comment]bool, []posRange) {
+	var directives []*ast.Comment
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matchTemplateConditional.MatchString(c.Text) {
+				directives = append(directives, c)
+			}
+		}
+	}
+	if len(directives) == 0 {
+		return nil, nil
+	}
+	sort.Slice(directives, func(i, j int) bool { return directives[i].Pos() < directives[j].Pos() })
+
+	// Work out which ranges of the source are dead
+	var (
+		stack     []conditional
+		dead      []posRange
+		deadStart token.Pos
+	)
+	live := func() bool {
+		for _, c := range stack {
+			if c.cond == c.inElse {
+				return false
+			}
+		}
+		return true
+	}
+	isDirective := map[*ast.Comment]bool{}
+	for _, c := range directives {
+		isDirective[c] = true
+		wasLive := live()
+		matches := matchTemplateConditional.FindStringSubmatch(c.Text)
+		switch matches[1] {
+		case "if":
+			expr, err := parser.ParseExpr(matches[2])
+			if err != nil {
+				fatalf("Failed to parse condition %q: %v", matches[2], err)
+			}
+			cond := true
+			if wasLive {
+				cond = t.evalCondition(matches[2], expr)
+			}
+			stack = append(stack, conditional{cond: cond})
+		case "else":
+			if len(stack) == 0 || stack[len(stack)-1].inElse {
+				fatalf("Found \"template else\" without \"template if\" in %s", t.inputFile)
+			}
+			stack[len(stack)-1].inElse = true
+		case "end":
+			if len(stack) == 0 {
+				fatalf("Found \"template end\" without \"template if\" in %s", t.inputFile)
+			}
+			stack = stack[:len(stack)-1]
+		}
+		isLive := live()
+		if wasLive && !isLive {
+			deadStart = c.End()
+		} else if !wasLive && isLive {
+			dead = append(dead, posRange{deadStart, c.Pos()})
+		}
+	}
+	if len(stack) != 0 {
+		fatalf("Missing \"template end\" in %s", t.inputFile)
+	}
+	debugf("Dead ranges = %v", dead)
+	return isDirective, dead
+}
+
+// pruneConditionals puts the source of fileName with the branches of
+// the "template if" sections not taken blanked out in conf.Overlay so
+// that only the branches taken are type checked. The branches may
+// then declare the same names.
+//
+// The blanks keep the positions of the rest of the source the same.
+func (t *template) pruneConditionals(conf *packages.Config, fileName string, src []byte) {
+	fset, f := parseFile(fileName, src)
+	_, dead := t.findConditionals(f)
+	if len(dead) == 0 {
+		return
+	}
+	src = append([]byte(nil), src...)
+	file := fset.File(f.Pos())
+	for _, r := range dead {
+		for i := file.Offset(r.from); i < file.Offset(r.to); i++ {
+			if src[i] != '\n' {
+				src[i] = ' '
+			}
+		}
+	}
+	if conf.Overlay == nil {
+		conf.Overlay = map[string][]byte{}
+	}
+	conf.Overlay[fileName] = src
+}
+
+// removeConditionals removes the declarations in the branches of the
+// "template if" sections not taken along with all the directives
+func (t *template) removeConditionals(f *ast.File) {
+	isDirective, dead := t.findConditionals(f)
+	if isDirective == nil {
+		return
+	}
+
+	isDead := func(pos token.Pos) bool {
+		for _, r := range dead {
+			if pos >= r.from && pos < r.to {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Remove the directives and the comments in the dead ranges
+	emptied := map[*ast.CommentGroup]bool{}
+	comments := f.Comments[:0]
+	for _, cg := range f.Comments {
+		list := cg.List[:0]
+		for _, c := range cg.List {
+			if !isDirective[c] && !isDead(c.Pos()) {
+				list = append(list, c)
+			}
+		}
+		cg.List = list
+		if len(list) == 0 {
+			emptied[cg] = true
+		} else {
+			comments = append(comments, cg)
+		}
+	}
+	f.Comments = comments
+	noDoc := func(doc **ast.CommentGroup) {
+		if emptied[*doc] {
+			*doc = nil
+		}
+	}
+
+	// Remove the dead declarations
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		if isDead(decl.Pos()) {
+			continue
+		}
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			noDoc(&d.Doc)
+		case *ast.GenDecl:
+			noDoc(&d.Doc)
+			specs := d.Specs[:0]
+			for _, spec := range d.Specs {
+				if isDead(spec.Pos()) {
+					continue
+				}
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					noDoc(&s.Doc)
+				case *ast.ValueSpec:
+					noDoc(&s.Doc)
+				case *ast.ImportSpec:
+					noDoc(&s.Doc)
+				}
+				specs = append(specs, spec)
+			}
+			d.Specs = specs
+			if len(specs) == 0 {
+				continue
+			}
+		}
+		decls = append(decls, decl)
+	}
+	f.Decls = decls
+}
@@ -0,0 +1,189 @@
+// Configuration files listing all the instantiations for a package
+// or module
+
+package gotemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Name of the configuration file
+const configFileName = "gotemplate.json"
+
+// An instantiation in the configuration file
+type configInstance struct {
+	Template        string            `json:"template"`                  // import path of the template
+	Instance        string            `json:"instance"`                  // eg "MySet(string)"
+	Dir             string            `json:"dir,omitempty"`             // relative to the config file
+	Output          string            `json:"output,omitempty"`          // output file name
+	Package         string            `json:"package,omitempty"`         // output package name
+	Naming          string            `json:"naming,omitempty"`          // prefix or suffix
+	Export          string            `json:"export,omitempty"`          // auto, public or private
+	Rename          map[string]string `json:"rename,omitempty"`          // explicit renames
+	Imports         map[string]string `json:"imports,omitempty"`         // packages the arguments use by name
+	Shared          *bool             `json:"shared,omitempty"`          // share helpers
+	Test            *bool             `json:"test,omitempty"`            // write to a _test.go file
+	Bundle          string            `json:"bundle,omitempty"`          // name of the bundle to write to
+	CollisionSuffix string            `json:"collisionSuffix,omitempty"` // suffix for colliding names
+	Force           *bool             `json:"force,omitempty"`           // write the instance even if it doesn't type check
+}
+
+// The configuration file
+type config struct {
+	Instances []configInstance `json:"instances"`
+}
+
+// findConfig looks for the configuration file in dir and then in its
+// parents up to the module root, returning "" if there isn't one
+func findConfig(dir string) string {
+	for {
+		fileName := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfig reads and checks the configuration file
+func readConfig(fileName string) *config {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		fatalf("Failed to read config: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	c := new(config)
+	if err := decoder.Decode(c); err != nil {
+		fatalf("Failed to parse %s: %v", fileName, err)
+	}
+	for i, instance := range c.Instances {
+		if instance.Template == "" || instance.Instance == "" {
+			fatalf("%s: instance %d needs a template and an instance", fileName, i+1)
+		}
+		if instance.Naming != "" {
+			checkNaming(instance.Naming)
+		}
+		if instance.Export != "" {
+			checkExport(instance.Export)
+		}
+	}
+	return c
+}
+
+// newTemplate makes the template for the instance in the config file
+// in configDir, with the options not set in the config file set from
+// o, using the lock file next to the config file
+func (instance *configInstance) newTemplate(configDir string, o *options) *template {
+	dir := configDir
+	if instance.Dir != "" {
+		dir = filepath.Join(configDir, filepath.FromSlash(instance.Dir))
+	}
+	var t *template
+	if instance.Package != "" {
+		t = newTemplateInPackage(dir, instance.Template, instance.Instance, instance.Package)
+	} else {
+		t = newTemplate(dir, instance.Template, instance.Instance)
+	}
+	o.apply(t)
+	t.outputFile = instance.Output
+	if instance.Naming != "" {
+		t.naming.prefix = instance.Naming == namingPrefix
+	}
+	if instance.Export != "" {
+		t.naming.export = instance.Export
+	}
+	for from, to := range instance.Rename {
+		t.naming.renames[from] = to
+	}
+	for alias, importPath := range instance.Imports {
+		t.importFlags[alias] = importPath
+	}
+	if instance.Shared != nil {
+		t.shareHelpers = *instance.Shared
+	}
+	if instance.Test != nil {
+		t.testOutput = *instance.Test
+	}
+	if t.testOutput && instance.Package == "" {
+		t.NewPackage = findTestPackageName(dir)
+	}
+	if instance.Bundle != "" {
+		t.bundle = true
+		t.bundleName = instance.Bundle
+	}
+	if instance.CollisionSuffix != "" {
+		t.collisionSuffix = instance.CollisionSuffix
+	}
+	if instance.Force != nil {
+		t.force = *instance.Force
+	}
+	t.lockFile = filepath.Join(configDir, lockFileName)
+	return t
+}
+
+// generate instantiates all the templates in the config file, which
+// is found from dir if fileName is empty, checking them against the
+// lock file next to it
+//
+// Up to jobs instances are generated at once and the errors are
+// reported in the order of the config file.
+func generate(dir, fileName string, o *options, jobs int) {
+	if fileName == "" {
+		fileName = findConfig(dir)
+		if fileName == "" {
+			fatalf("Didn't find %s in %q or its parents", configFileName, dir)
+		}
+	} else if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(dir, fileName)
+	}
+	c := readConfig(fileName)
+	configDir := filepath.Dir(fileName)
+	templates := make([]*template, len(c.Instances))
+	outputs := map[string]int{}
+	bundles := map[string]map[string]bool{}
+	for i := range c.Instances {
+		t := c.Instances[i].newTemplate(configDir, o)
+		outputFile := filepath.Join(t.Dir, t.outputFileName())
+		if j, found := outputs[outputFile]; found && !(t.bundle && templates[j].bundle) {
+			fatalf("%s: instances %d and %d are both written to %q", fileName, j+1, i+1, outputFile)
+		}
+		outputs[outputFile] = i
+		if t.bundle {
+			members := bundles[outputFile]
+			if members == nil {
+				members = map[string]bool{}
+				bundles[outputFile] = members
+			}
+			if members[t.Name] {
+				fatalf("%s: instance %d is the second called %s in %q", fileName, i+1, t.Name, outputFile)
+			}
+			members[t.Name] = true
+			t.bundleInstances = members
+		}
+		debugf("Generating %s(%s) from %q in %q", t.Name, t.Args, t.Package, t.Dir)
+		templates[i] = t
+	}
+	var failed diagnostics
+	for i, err := range instantiateAll(templates, jobs) {
+		if err != nil {
+			source := fmt.Sprintf("%s instance %d", fileName, i+1)
+			failed = append(failed, errorDiagnostics(err).withContext(source, templates[i])...)
+		}
+	}
+	if len(failed) > 0 {
+		fatalf("%v", failed)
+	}
+}
@@ -0,0 +1,303 @@
+// Maps coverage profiles of instances back onto their templates
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"golang.org/x/tools/cover"
+)
+
+// A line and column as used in coverage profiles
+type lineCol struct {
+	line, col int
+}
+
+// Maps a top level declaration of an instance onto the template
+type declMap struct {
+	line         int                 // line the declaration starts on in the instance
+	templateLine int                 // line it starts on in the template
+	positions    map[lineCol]lineCol // positions of the nodes if they match
+}
+
+// Maps the positions in an instance onto the template
+type instanceMap struct {
+	templateFile string    // template file name as used in profiles
+	decls        []declMap // in order of line
+}
+
+// position returns the position in the template of line and col in
+// the instance
+//
+// Positions which don't start or end a node in the template are
+// found from their offset from the start of the declaration.
+func (m *instanceMap) position(line, col int) lineCol {
+	i := sort.Search(len(m.decls), func(i int) bool {
+		return m.decls[i].line > line
+	}) - 1
+	if i < 0 {
+		return lineCol{line, col}
+	}
+	d := m.decls[i]
+	if p, ok := d.positions[lineCol{line, col}]; ok {
+		return p
+	}
+	return lineCol{d.templateLine + line - d.line, col}
+}
+
+// declNodes returns the nodes in decl in the order ast.Inspect finds
+// them, without the comments which may differ between the template
+// and the instance
+func declNodes(decl ast.Decl) (nodes []ast.Node) {
+	ast.Inspect(decl, func(n ast.Node) bool {
+		switch n.(type) {
+		case nil, *ast.CommentGroup, *ast.Comment:
+			return false
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+	return nodes
+}
+
+// nodePositions returns the positions where coverage blocks can
+// start or end in n
+func nodePositions(n ast.Node) []token.Pos {
+	positions := []token.Pos{n.Pos(), n.End()}
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		positions = append(positions, n.Lbrace, n.Lbrace+1, n.Rbrace)
+	case *ast.CaseClause:
+		positions = append(positions, n.Colon, n.Colon+1)
+	case *ast.CommClause:
+		positions = append(positions, n.Colon, n.Colon+1)
+	}
+	return positions
+}
+
+// matchDecls maps the positions in the instance declaration onto the
+// template declaration it was made from if they have the same shape
+func matchDecls(instanceFset *token.FileSet, instanceDecl ast.Decl, templateFset *token.FileSet, templateDecl ast.Decl) map[lineCol]lineCol {
+	instanceNodes, templateNodes := declNodes(instanceDecl), declNodes(templateDecl)
+	if len(instanceNodes) != len(templateNodes) {
+		return nil
+	}
+	lineColOf := func(fset *token.FileSet, pos token.Pos) lineCol {
+		p := fset.Position(pos)
+		return lineCol{p.Line, p.Column}
+	}
+	positions := map[lineCol]lineCol{}
+	for i, n := range instanceNodes {
+		if reflect.TypeOf(n) != reflect.TypeOf(templateNodes[i]) {
+			return nil
+		}
+		templatePositions := nodePositions(templateNodes[i])
+		for j, pos := range nodePositions(n) {
+			positions[lineColOf(instanceFset, pos)] = lineColOf(templateFset, templatePositions[j])
+		}
+	}
+	return positions
+}
+
+// mapInstance makes the map from the instance in fileName to the
+// template it was made from by t
+//
+// It is a fatal error if the instance isn't what t makes now.
+func mapInstance(t *template, fileName string, src []byte) *instanceMap {
+	if t.bundle {
+		fatalf("%s is a bundle which can't be mapped", fileName)
+	}
+	if !bytes.Equal(t.instanceSource(), src) {
+		fatalf("%s is out of date - regenerate it first", fileName)
+	}
+	p, _ := importTemplate(t.Package, t.Dir)
+	m := &instanceMap{
+		templateFile: path.Join(p.ImportPath, filepath.Base(t.inputFile)),
+	}
+
+	instanceFset, instanceFile := parseFile(fileName, src)
+	templateFset := token.NewFileSet()
+	templateFile, err := parser.ParseFile(templateFset, t.inputFile, nil, 0)
+	if err != nil {
+		fatalf("Failed to parse template: %v", err)
+	}
+	templateDecls := map[lineCol]ast.Decl{}
+	for _, decl := range templateFile.Decls {
+		p := templateFset.Position(decl.Pos())
+		templateDecls[lineCol{p.Line, p.Column}] = decl
+	}
+
+	decls := instanceDecls(instanceFile)
+	if len(decls) != len(t.declPositions) {
+		fatalf("Can't map %s onto the template as it has %d declarations but the template makes %d", fileName, len(decls), len(t.declPositions))
+	}
+	for i, decl := range decls {
+		pos := t.declPositions[i]
+		d := declMap{
+			line:         instanceFset.Position(decl.Pos()).Line,
+			templateLine: pos.Line,
+		}
+		if templateDecl := templateDecls[lineCol{pos.Line, pos.Column}]; templateDecl != nil {
+			d.positions = matchDecls(instanceFset, decl, templateFset, templateDecl)
+		}
+		if d.positions == nil {
+			debugf("%s: %s doesn't match the template so using line offsets", fileName, instanceFset.Position(decl.Pos()))
+		}
+		m.decls = append(m.decls, d)
+	}
+	return m
+}
+
+// Finds the instances coverage profiles refer to
+type coverMapper struct {
+	dir       string                  // directory to find packages from
+	instances map[string]*instanceMap // by profile file name, nil if not an instance
+}
+
+// findInstance returns the template which makes the instance in
+// fileName, looking at the directives and config files in its
+// directory, or nil if none do
+func findInstance(fileName string) *template {
+	w := &watcher{dir: filepath.Dir(fileName), patterns: []string{"."}}
+	w.index()
+	for _, instance := range w.instances {
+		var t *template
+		err := catchFatal(func() {
+			t = instance.newTemplate()
+		})
+		if err == nil && filepath.Join(t.Dir, t.outputFileName()) == fileName {
+			return t
+		}
+	}
+	return nil
+}
+
+// instanceMap returns the map for the file in the profile or nil if
+// it isn't an instance
+func (c *coverMapper) instanceMap(profileFile string) *instanceMap {
+	if m, found := c.instances[profileFile]; found {
+		return m
+	}
+	c.instances[profileFile] = nil
+	importPath := path.Dir(profileFile)
+	p, err := build.Default.Import(importPath, c.dir, build.FindOnly)
+	if err != nil {
+		logf("Can't find package %q: %v", importPath, err)
+		return nil
+	}
+	fileName := filepath.Join(p.Dir, path.Base(profileFile))
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		logf("Can't read %q: %v", fileName, err)
+		return nil
+	}
+	if !bytes.HasPrefix(src, []byte(genHeader)) {
+		return nil
+	}
+	t := findInstance(fileName)
+	if t == nil {
+		logf("%s: didn't find the gotemplate directive which makes it", fileName)
+		return nil
+	}
+	var m *instanceMap
+	if err := catchFatal(func() { m = mapInstance(t, fileName, src) }); err != nil {
+		logf("%s: %v", fileName, err)
+		return nil
+	}
+	debugf("%s is %s(%s) of %s", fileName, t.Name, t.Args, m.templateFile)
+	c.instances[profileFile] = m
+	return m
+}
+
+// coverBlock identifies a block in a profile
+type coverBlock struct {
+	fileName           string
+	startLine, endLine int
+	startCol, endCol   int
+}
+
+// coverage combines the profiles, mapping the blocks in instances onto
+// their templates and writing the result to w
+//
+// Blocks in the same place in the template are combined so it shows
+// the coverage from all the instances.
+func coverage(w io.Writer, dir string, profileFiles []string) {
+	c := &coverMapper{dir: dir, instances: map[string]*instanceMap{}}
+	mode := ""
+	blocks := map[coverBlock]*cover.ProfileBlock{}
+	for _, profileFile := range profileFiles {
+		profiles, err := cover.ParseProfiles(profileFile)
+		if err != nil {
+			fatalf("Failed to read coverage profile: %v", err)
+		}
+		for _, profile := range profiles {
+			if mode == "" {
+				mode = profile.Mode
+			} else if profile.Mode != mode {
+				fatalf("%s: can't combine mode %q with mode %q", profileFile, profile.Mode, mode)
+			}
+			m := c.instanceMap(profile.FileName)
+			for _, b := range profile.Blocks {
+				key := coverBlock{profile.FileName, b.StartLine, b.EndLine, b.StartCol, b.EndCol}
+				if m != nil {
+					start, end := m.position(b.StartLine, b.StartCol), m.position(b.EndLine, b.EndCol)
+					key = coverBlock{m.templateFile, start.line, end.line, start.col, end.col}
+				}
+				combined := blocks[key]
+				if combined == nil {
+					blocks[key] = &cover.ProfileBlock{
+						StartLine: key.startLine, StartCol: key.startCol,
+						EndLine: key.endLine, EndCol: key.endCol,
+						NumStmt: b.NumStmt, Count: b.Count,
+					}
+				} else if mode == "set" {
+					if b.Count > combined.Count {
+						combined.Count = b.Count
+					}
+				} else {
+					combined.Count += b.Count
+				}
+			}
+		}
+	}
+	if mode == "" {
+		fatalf("No coverage profiles found")
+	}
+
+	keys := make([]coverBlock, 0, len(blocks))
+	for key := range blocks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.fileName != b.fileName {
+			return a.fileName < b.fileName
+		}
+		if a.startLine != b.startLine {
+			return a.startLine < b.startLine
+		}
+		if a.startCol != b.startCol {
+			return a.startCol < b.startCol
+		}
+		if a.endLine != b.endLine {
+			return a.endLine < b.endLine
+		}
+		return a.endCol < b.endCol
+	})
+	fmt.Fprintf(w, "mode: %s\n", mode)
+	for _, key := range keys {
+		b := blocks[key]
+		fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", key.fileName, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt, b.Count)
+	}
+}
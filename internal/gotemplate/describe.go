@@ -0,0 +1,131 @@
+// Describes a template package for the "describe" command
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// declKind returns what sort of declaration decl is
+func declKind(decl *ast.GenDecl) string {
+	switch decl.Tok {
+	case token.TYPE:
+		return "type"
+	case token.CONST:
+		return "const"
+	}
+	return "var"
+}
+
+// describe writes a description of the template package pkg found
+// from dir to w, showing its parameters, the top level declarations
+// which will be renamed along with any directives on them and its
+// specializations
+func describe(w io.Writer, dir, pkg string) {
+	p, filePath := importTemplate(pkg, dir)
+	_, f := parseFile(filePath, nil)
+
+	definition := ""
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matches := matchTemplateType.FindStringSubmatch(c.Text); matches != nil {
+				definition = matches[1]
+			}
+		}
+	}
+	if definition == "" {
+		fatalf("Didn't find template definition in %s", filePath)
+	}
+	_, params, variadic, pkgParams := parseTemplateDefinition(definition)
+	isParam := map[string]bool{}
+	for _, param := range params {
+		isParam[param] = true
+	}
+
+	// Find the kinds of all the top level declarations
+	type decl struct {
+		id   *ast.Ident
+		kind string
+	}
+	var decls []decl
+	kinds := map[string]string{}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil && d.Name.Name != "init" {
+				kind := "func"
+				if d.Type.TypeParams != nil {
+					kind = "generic func"
+				}
+				decls = append(decls, decl{d.Name, kind})
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					kind := declKind(d)
+					if spec.Assign.IsValid() {
+						kind = "type alias"
+					} else if spec.TypeParams != nil {
+						kind = "generic type"
+					}
+					decls = append(decls, decl{spec.Name, kind})
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						decls = append(decls, decl{id, declKind(d)})
+					}
+				}
+			}
+		}
+	}
+	for _, d := range decls {
+		kinds[d.id.Name] = d.kind
+	}
+	directives, _ := findDeclDirectives(f)
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Template %s in %s\n", definition, filePath)
+	fmt.Fprintf(tw, "\nParameters:\n")
+	for i, param := range params {
+		kind := kinds[param]
+		if pkgParams[param] {
+			kind = "package"
+		}
+		if variadic && i == len(params)-1 {
+			kind += ", variadic"
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\n", param, kind)
+	}
+	fmt.Fprintf(tw, "\nDeclarations:\n")
+	for _, d := range decls {
+		if isParam[d.id.Name] || d.id.Name == "_" {
+			continue
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\t%s\n", d.id.Name, d.kind, directives[d.id])
+	}
+	specializations := findSpecializations(p)
+	if len(specializations) > 0 {
+		fmt.Fprintf(tw, "\nSpecializations:\n")
+		for _, s := range specializations {
+			fmt.Fprintf(tw, "\t%s\t%s\n", strings.TrimSpace(s.spec), path.Base(s.filePath))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		fatalf("Failed to format description: %v", err)
+	}
+
+	// Remove the padding from the empty last columns
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if _, err := io.WriteString(w, strings.TrimRight(line, " ")+"\n"); err != nil {
+			fatalf("Failed to write description: %v", err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Directives on the declarations of a template which control how
+// they are renamed
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// "gotemplate:keep", "gotemplate:name New{{Name}}", "gotemplate:private"
+var matchDeclDirective = regexp.MustCompile(`^//\s*gotemplate:(\w+)\b\s*(.*?)\s*$`)
+
+// The directives on a declaration
+type declDirective struct {
+	keep    bool   // leave the name alone
+	name    string // name to use with {{Name}} standing for the instance name
+	private bool   // never export the name
+}
+
+// String describes the directives
+func (d declDirective) String() string {
+	var s []string
+	if d.keep {
+		s = append(s, "keep")
+	}
+	if d.name != "" {
+		s = append(s, "name "+d.name)
+	}
+	if d.private {
+		s = append(s, "private")
+	}
+	return strings.Join(s, ", ")
+}
+
+// expandName returns the name given by a "gotemplate:name" directive
+// for the instance called instanceName
+func (d declDirective) expandName(instanceName string) string {
+	name := strings.Replace(d.name, "{{Name}}", instanceName, -1)
+	if strings.Contains(name, "{{") {
+		fatalf("Unknown substitution in \"gotemplate:name %s\" - only {{Name}} is supported", d.name)
+	}
+	return name
+}
+
+// parseDeclDirectives adds the directives in doc to d, returning the
+// comments which were directives
+func parseDeclDirectives(doc *ast.CommentGroup, d declDirective) (declDirective, []*ast.Comment) {
+	if doc == nil {
+		return d, nil
+	}
+	var directives []*ast.Comment
+	for _, c := range doc.List {
+		matches := matchDeclDirective.FindStringSubmatch(c.Text)
+		if matches == nil {
+			continue
+		}
+		switch matches[1] {
+		case "keep":
+			d.keep = true
+		case "name":
+			if !token.IsIdentifier(strings.Replace(matches[2], "{{Name}}", "X", -1)) {
+				fatalf("Bad name %q in \"gotemplate:name\"", matches[2])
+			}
+			d.name = matches[2]
+		case "private":
+			d.private = true
+		default:
+			fatalf("Unknown directive %q", c.Text)
+		}
+		directives = append(directives, c)
+	}
+	return d, directives
+}
+
+// findDeclDirectives returns the directives for the top level
+// identifiers declared in f and the comments they came from.
+//
+// Directives on a grouped declaration apply to all of its specs.
+func findDeclDirectives(f *ast.File) (map[*ast.Ident]declDirective, map[*ast.Comment]bool) {
+	found := map[*ast.Ident]declDirective{}
+	comments := map[*ast.Comment]bool{}
+	addComments := func(directives []*ast.Comment) {
+		for _, c := range directives {
+			comments[c] = true
+		}
+	}
+	add := func(id *ast.Ident, d declDirective, directives []*ast.Comment) {
+		if d != (declDirective{}) {
+			found[id] = d
+		}
+		addComments(directives)
+	}
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			d, directives := parseDeclDirectives(decl.Doc, declDirective{})
+			add(decl.Name, d, directives)
+		case *ast.GenDecl:
+			declD, directives := parseDeclDirectives(decl.Doc, declDirective{})
+			addComments(directives)
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					d, directives := parseDeclDirectives(spec.Doc, declD)
+					add(spec.Name, d, directives)
+				case *ast.ValueSpec:
+					d, directives := parseDeclDirectives(spec.Doc, declD)
+					for _, id := range spec.Names {
+						add(id, d, directives)
+					}
+				}
+			}
+		}
+	}
+	return found, comments
+}
+
+// removeDirectiveComments removes the comments from f, removing any
+// doc comments which are left empty.
+//
+// The lines the comments were on are merged into the following lines
+// so they don't leave gaps in the output. This changes the positions
+// in fset so should be done just before printing.
+func removeDirectiveComments(fset *token.FileSet, f *ast.File, remove map[*ast.Comment]bool) {
+	if len(remove) == 0 {
+		return
+	}
+	var lines []int
+	removeLine := func(c *ast.Comment) {
+		lines = append(lines, fset.Position(c.Pos()).Line)
+	}
+	emptied := map[*ast.CommentGroup]bool{}
+	comments := f.Comments[:0]
+	for _, cg := range f.Comments {
+		list := cg.List[:0]
+		removed := false
+		for _, c := range cg.List {
+			if remove[c] {
+				removeLine(c)
+				removed = true
+			} else {
+				list = append(list, c)
+			}
+		}
+		// Remove any blank lines which separated the directives
+		for removed && len(list) > 0 && list[len(list)-1].Text == "//" {
+			removeLine(list[len(list)-1])
+			list = list[:len(list)-1]
+		}
+		cg.List = list
+		if len(list) == 0 {
+			emptied[cg] = true
+		} else {
+			comments = append(comments, cg)
+		}
+	}
+	f.Comments = comments
+	noDoc := func(doc **ast.CommentGroup) {
+		if emptied[*doc] {
+			*doc = nil
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			noDoc(&n.Doc)
+		case *ast.GenDecl:
+			noDoc(&n.Doc)
+		case *ast.TypeSpec:
+			noDoc(&n.Doc)
+		case *ast.ValueSpec:
+			noDoc(&n.Doc)
+		}
+		return true
+	})
+
+	// Merge from the bottom up so the line numbers stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(lines)))
+	file := fset.File(f.Pos())
+	for _, line := range lines {
+		file.MergeLine(line)
+	}
+}
@@ -0,0 +1,236 @@
+// Machine readable events and diagnostics for -json
+
+package gotemplate
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Actions of the events
+const (
+	actionStart      = "start"      // instantiation started
+	actionWrite      = "write"      // file written
+	actionUnchanged  = "unchanged"  // file already up to date
+	actionDiagnostic = "diagnostic" // problem found
+	actionLog        = "log"        // any other message
+)
+
+// Severity of the diagnostics for fatal errors
+const severityError = "error"
+
+// An event printed as a line of JSON with -json
+type event struct {
+	Action   string `json:"action"`
+	Source   string `json:"source,omitempty"`   // where the instance came from, eg "gotemplate.json instance 2"
+	Template string `json:"template,omitempty"` // import path of the template
+	Instance string `json:"instance,omitempty"` // eg "MySet(int)"
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Code     string `json:"code,omitempty"` // kind of diagnostic, eg "typecheck"
+	Message  string `json:"message,omitempty"`
+	Context  string `json:"context,omitempty"` // line of source the diagnostic is on
+}
+
+// String formats a diagnostic in the same way as the compiler
+func (e event) String() string {
+	s := e.Message
+	if e.File != "" {
+		position := token.Position{Filename: e.File, Line: e.Line, Column: e.Column}
+		s = position.String() + ": " + s
+	}
+	if e.Source != "" {
+		s = e.Source + ": " + s
+	}
+	if e.Context != "" {
+		s += "\n\t" + e.Context + "\n\t" + caret(e.Context, e.Column)
+	}
+	return s
+}
+
+// caret returns a line with a ^ under column of line, keeping the
+// tabs so it lines up
+func caret(line string, column int) string {
+	if column < 1 || column > len(line)+1 {
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, line[:column-1]) + "^"
+}
+
+// sourceContext returns the line of source at pos or "" if it can't
+// be read
+func sourceContext(pos token.Position) string {
+	if pos.Filename == "" {
+		return ""
+	}
+	b, err := ioutil.ReadFile(pos.Filename)
+	if err != nil {
+		return ""
+	}
+	return sourceLine(b, pos.Line)
+}
+
+// sourceLine returns line number line of src or "" if there isn't one
+func sourceLine(src []byte, line int) string {
+	lines := strings.Split(string(src), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
+}
+
+// newDiagnostic makes a diagnostic at pos, which may be invalid
+func newDiagnostic(severity, code string, pos token.Position, format string, args ...interface{}) event {
+	return event{
+		Action:   actionDiagnostic,
+		File:     pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Context:  sourceContext(pos),
+	}
+}
+
+// Diagnostics which can be passed as an argument to fatalf to be
+// reported individually with -json
+type diagnostics []event
+
+// String formats the diagnostics one per line
+func (ds diagnostics) String() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// errorDiagnostics returns the diagnostics of an error returned by
+// recoverFatal
+func errorDiagnostics(err error) diagnostics {
+	if e, ok := err.(fatalError); ok {
+		return append(diagnostics(nil), e.diagnostics...)
+	}
+	return diagnostics{newDiagnostic(severityError, "", token.Position{}, "%v", err)}
+}
+
+// withContext returns the diagnostics with the instance they came
+// from filled in, t may be nil if it isn't known
+func (ds diagnostics) withContext(source string, t *template) diagnostics {
+	for i := range ds {
+		ds[i].Source = source
+		if t != nil {
+			ds[i].Template = t.Package
+			ds[i].Instance = t.spec()
+		}
+	}
+	return ds
+}
+
+// packageDiagnostics converts all the errors from loading pkgs and
+// their dependencies into diagnostics, keeping their positions
+func packageDiagnostics(pkgs []*packages.Package) diagnostics {
+	var errs []packages.Error
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		errs = append(errs, pkg.Errors...)
+	})
+	var ds diagnostics
+	for _, err := range errs {
+		code := "typecheck"
+		switch err.Kind {
+		case packages.ListError:
+			code = "list"
+		case packages.ParseError:
+			code = "parse"
+		}
+		ds = append(ds, newDiagnostic(severityError, code, parsePosition(err.Pos), "%s", err.Msg))
+	}
+	return ds
+}
+
+// parsePosition parses a position in the form "file:line:column",
+// "file:line" or "file" as used by packages.Error
+func parsePosition(s string) (pos token.Position) {
+	if s == "" || s == "-" {
+		return pos
+	}
+	pos.Filename = s
+	for _, field := range []*int{&pos.Column, &pos.Line} {
+		i := strings.LastIndex(pos.Filename, ":")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(pos.Filename[i+1:])
+		if err != nil {
+			break
+		}
+		*field = n
+		pos.Filename = pos.Filename[:i]
+	}
+	if pos.Line == 0 {
+		// only one number so it was the line
+		pos.Line, pos.Column = pos.Column, 0
+	}
+	return pos
+}
+
+// Where the events are written
+var eventOutput io.Writer = os.Stdout
+
+// Makes sure events from parallel instantiations don't interleave
+var eventMu sync.Mutex
+
+// emit prints the event if -json is set
+func emit(e event) {
+	if !*jsonOutput {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = eventOutput.Write(append(b, '\n'))
+}
+
+// emitError prints the diagnostics of an error from recoverFatal
+func emitError(err error) {
+	for _, d := range errorDiagnostics(err) {
+		emit(d)
+	}
+}
+
+// reportError logs an error from recoverFatal for the instance from
+// source, reporting its diagnostics with -json
+func reportError(source string, t *template, err error) {
+	if !*jsonOutput {
+		logf("%s: %v", source, err)
+		return
+	}
+	for _, d := range errorDiagnostics(err).withContext(source, t) {
+		emit(d)
+	}
+}
+
+// jsonLogf is logf with -json
+func jsonLogf(format string, args ...interface{}) {
+	emit(event{Action: actionLog, Message: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,68 @@
+// Line directives mapping the instance back to the template
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"strconv"
+)
+
+// declPositions returns the positions in the template of the top
+// level declarations in f
+//
+// This must be called before f is changed as removing comments
+// changes the line numbers the file set reports.
+func declPositions(fset *token.FileSet, f *ast.File) map[ast.Decl]token.Position {
+	positions := map[ast.Decl]token.Position{}
+	for _, decl := range f.Decls {
+		positions[decl] = fset.Position(decl.Pos())
+	}
+	return positions
+}
+
+// instanceDecls returns the top level declarations which are copied
+// from the template into the instance, which are all but the imports
+func instanceDecls(f *ast.File) (decls []ast.Decl) {
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// lineDirective returns a //line comment for pos with the file name
+// relative to the directory the instance is written to
+func (t *template) lineDirective(pos token.Position) string {
+	fileName := pos.Filename
+	if rel, err := filepath.Rel(t.Dir, fileName); err == nil {
+		fileName = rel
+	}
+	return "//line " + filepath.ToSlash(fileName) + ":" + strconv.Itoa(pos.Line) + "\n"
+}
+
+// addLineDirectives inserts a //line comment before each top level
+// declaration in src, the formatted instance, giving the position in
+// the template of the declaration it came from
+//
+// The declarations must be in the same order as t.declPositions.
+func (t *template) addLineDirectives(fileName string, src []byte) []byte {
+	fset, f := parseFile(fileName, src)
+	decls := instanceDecls(f)
+	if len(decls) != len(t.declPositions) {
+		fatalf("Internal error: found %d declarations in the instance but expecting %d", len(decls), len(t.declPositions))
+	}
+	var out []byte
+	last := 0
+	for i, decl := range decls {
+		file := fset.File(decl.Pos())
+		start := file.Offset(file.LineStart(file.Line(decl.Pos())))
+		out = append(out, src[last:start]...)
+		out = append(out, t.lineDirective(t.declPositions[i])...)
+		last = start
+	}
+	return append(out, src[last:]...)
+}
@@ -0,0 +1,129 @@
+// Loading packages type checked from source
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// What loadPackages asks go/packages for - the files of the packages
+// and the export data of their dependencies, but no types
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedImports | packages.NeedDeps | packages.NeedExportFile | packages.NeedModule
+
+// loadPackages loads the packages matching patterns, parsing and type
+// checking them from source against the export data of their
+// dependencies.
+//
+// go/packages can type check packages from export data itself but it
+// can't read the export data of newer Go releases than it knows
+// about, whereas go/importer always matches the toolchain gotemplate
+// is built with.  This avoids type checking all the dependencies,
+// including the standard library, from source too.
+func loadPackages(conf *packages.Config, patterns ...string) ([]*packages.Package, error) {
+	conf.Mode = loadMode
+	pkgs, err := packages.Load(conf, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	// The export data for each package path, for the packages the
+	// export data refers to without importing them directly
+	exportFiles := map[string]string{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if pkg.ExportFile != "" {
+			exportFiles[pkg.PkgPath] = pkg.ExportFile
+		}
+	})
+	fset := token.NewFileSet()
+	for _, pkg := range pkgs {
+		typeCheckPackage(conf, fset, pkg, exportFiles)
+	}
+	return pkgs, nil
+}
+
+// typeCheckPackage parses and type checks pkg, filling in the fields
+// which go/packages would have done with packages.LoadSyntax
+//
+// Any errors are recorded in pkg.Errors and pkg.TypeErrors.
+func typeCheckPackage(conf *packages.Config, fset *token.FileSet, pkg *packages.Package, exportFiles map[string]string) {
+	// The compiler's errors building the export data of the
+	// package, which start with "# " and the package, are found
+	// again below
+	errs := pkg.Errors[:0]
+	for _, err := range pkg.Errors {
+		if !strings.HasPrefix(err.Msg, "# ") {
+			errs = append(errs, err)
+		}
+	}
+	pkg.Errors = errs
+
+	pkg.Fset = fset
+	pkg.Syntax = nil
+	for _, fileName := range pkg.CompiledGoFiles {
+		var src interface{}
+		if b, ok := conf.Overlay[fileName]; ok {
+			src = b
+		}
+		f, err := parser.ParseFile(fset, fileName, src, parser.ParseComments)
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				pkg.Errors = append(pkg.Errors, packages.Error{Pos: e.Pos.String(), Msg: e.Msg, Kind: packages.ParseError})
+			}
+		} else if err != nil {
+			pkg.Errors = append(pkg.Errors, packages.Error{Pos: fileName, Msg: err.Error(), Kind: packages.ParseError})
+		}
+		if f != nil {
+			pkg.Syntax = append(pkg.Syntax, f)
+		}
+	}
+
+	lookup := func(path string) (io.ReadCloser, error) {
+		exportFile := exportFiles[path]
+		if imp := pkg.Imports[path]; imp != nil {
+			exportFile = imp.ExportFile
+		}
+		if exportFile == "" {
+			return nil, os.ErrNotExist
+		}
+		return os.Open(exportFile)
+	}
+	pkg.TypesSizes = types.SizesFor("gc", runtime.GOARCH)
+	pkg.TypesInfo = &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Implicits:  map[ast.Node]types.Object{},
+		Instances:  map[*ast.Ident]types.Instance{},
+		Scopes:     map[ast.Node]*types.Scope{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+	}
+	tc := &types.Config{
+		Importer: importer.ForCompiler(fset, "gc", lookup),
+		Sizes:    pkg.TypesSizes,
+		Error: func(err error) {
+			typeErr := err.(types.Error)
+			pkg.TypeErrors = append(pkg.TypeErrors, typeErr)
+			pkg.Errors = append(pkg.Errors, packages.Error{
+				Pos:  typeErr.Fset.Position(typeErr.Pos).String(),
+				Msg:  typeErr.Msg,
+				Kind: packages.TypeError,
+			})
+		},
+	}
+	if pkg.Module != nil && pkg.Module.GoVersion != "" {
+		tc.GoVersion = "go" + pkg.Module.GoVersion
+	}
+	pkg.Types, _ = tc.Check(pkg.PkgPath, fset, pkg.Syntax, pkg.TypesInfo)
+	pkg.IllTyped = len(pkg.Errors) > 0
+}
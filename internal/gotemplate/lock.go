@@ -0,0 +1,128 @@
+// Lock file recording the versions and hashes of the templates used
+
+package gotemplate
+
+import (
+	"bytes"
+	"go/build"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/tools/go/packages"
+)
+
+// Name of the lock file
+const lockFileName = "gotemplate.lock"
+
+// Version recorded for templates which aren't in a versioned module
+const develVersion = "(devel)"
+
+// What the lock file records about a template
+type lockEntry struct {
+	version string
+	hash    string
+}
+
+// readLock reads the lock file returning the entries by template
+// import path
+func readLock(fileName string) map[string]lockEntry {
+	entries := map[string]lockEntry{}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return entries
+	} else if err != nil {
+		fatalf("Failed to read lock file: %v", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			fatalf("%s:%d: expecting import path, version and hash", fileName, i+1)
+		}
+		entries[fields[0]] = lockEntry{version: fields[1], hash: fields[2]}
+	}
+	return entries
+}
+
+// writeLock writes the entries to the lock file sorted by import path
+func writeLock(fileName string, entries map[string]lockEntry) {
+	var paths []string
+	for importPath := range entries {
+		paths = append(paths, importPath)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	for _, importPath := range paths {
+		entry := entries[importPath]
+		b.WriteString(importPath + " " + entry.version + " " + entry.hash + "\n")
+	}
+	writeFile(fileName, b.Bytes())
+}
+
+// templateHash returns a hash of the source files of the template
+// package which could be read when instantiating it, including any
+// specializations, in the same format as go.sum
+func templateHash(p *build.Package) string {
+	var files []string
+	for _, name := range append(append([]string{}, p.GoFiles...), p.IgnoredGoFiles...) {
+		if !strings.HasSuffix(name, "_test.go") {
+			files = append(files, name)
+		}
+	}
+	hash, err := dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(p.Dir, name))
+	})
+	if err != nil {
+		fatalf("Failed to hash template %q: %v", p.ImportPath, err)
+	}
+	return hash
+}
+
+// templateVersion returns the version of the module the template
+// package comes from
+func (t *template) templateVersion() string {
+	conf := &packages.Config{
+		Mode: packages.NeedName | packages.NeedModule,
+		Dir:  t.Dir,
+	}
+	pkgs, err := packages.Load(conf, t.Package)
+	if err != nil || len(pkgs) != 1 || pkgs[0].Module == nil || pkgs[0].Module.Version == "" {
+		debugf("No module version for %q: %v", t.Package, err)
+		return develVersion
+	}
+	return pkgs[0].Module.Version
+}
+
+// checkLock makes sure the template package p matches the lock file,
+// adding it if it isn't there.
+//
+// If it doesn't match then it is a fatal error unless the lock is
+// being updated.
+//
+// The lock file is shared by the instances generated in parallel so
+// it is only updated by one of them at a time.
+func (t *template) checkLock(p *build.Package) {
+	defer lockPath(t.lockFile)()
+	entries := readLock(t.lockFile)
+	entry := lockEntry{
+		version: t.templateVersion(),
+		hash:    templateHash(p),
+	}
+	old, found := entries[t.templatePath]
+	if found && old != entry && !t.updateLock {
+		fatalf("%v", diagnostics{newDiagnostic(severityError, "lock", token.Position{Filename: t.lockFile}, "Template %q is %s %s but the lock has %s %s - check the changes then use -update-lock", t.templatePath, entry.version, entry.hash, old.version, old.hash)})
+	}
+	if old != entry {
+		debugf("Updating %s with %q %s %s", t.lockFile, t.templatePath, entry.version, entry.hash)
+		entries[t.templatePath] = entry
+		writeLock(t.lockFile, entries)
+	}
+}
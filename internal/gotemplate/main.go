@@ -0,0 +1,208 @@
+// Package gotemplate implements the gotemplate command and its
+// analyzer
+package gotemplate
+
+import (
+	"flag"
+	"fmt"
+	"go/token"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"time"
+)
+
+// Globals
+var (
+	// Flags of the command, kept out of flag.CommandLine so
+	// programs importing the analyzer can use their own
+	commandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	verbose     = commandLine.Bool("v", false, "Verbose - print lots of stuff")
+	poll        = commandLine.Duration("poll", time.Second, "How often watch looks for changes")
+	jobs        = commandLine.Int("j", runtime.NumCPU(), "Number of instantiations generate runs at once")
+	jsonOutput  = commandLine.Bool("json", false, "Print a stream of JSON events instead of messages")
+	generators  = renameFlag{}
+	opts        = newOptions(commandLine)
+)
+
+func init() {
+	commandLine.Var(generators, "generator", "Replace a \"template generator\" of the tests with test, eg -generator newA=newPoint - can be repeated")
+}
+
+// Logging function
+var logf = log.Printf
+
+// Fatal error - main logs it and exits
+var fatalf = raisef
+
+// A fatal error caught by recoverFatal
+type fatalError struct {
+	message     string
+	diagnostics diagnostics
+}
+
+// Error returns the message passed to fatalf
+func (e fatalError) Error() string {
+	return e.message
+}
+
+// raisef is the default fatalf which panics with the error for
+// recoverFatal to catch
+//
+// Any diagnostics in args are kept so they can be reported with
+// -json, otherwise the message becomes the diagnostic.
+func raisef(format string, args ...interface{}) {
+	e := fatalError{message: fmt.Sprintf(format, args...)}
+	for _, arg := range args {
+		if ds, ok := arg.(diagnostics); ok {
+			e.diagnostics = append(e.diagnostics, ds...)
+		}
+	}
+	if len(e.diagnostics) == 0 {
+		e.diagnostics = diagnostics{newDiagnostic(severityError, "", token.Position{}, "%s", e.message)}
+	}
+	panic(e)
+}
+
+// catchFatal runs fn returning the error passed to fatalf rather than
+// exiting if it is called
+func catchFatal(fn func()) error {
+	defer raiseFatal()()
+	return recoverFatal(fn)
+}
+
+// raiseFatal makes fatalf panic with the error so recoverFatal can
+// catch it, returning a function to restore it
+//
+// This must be called before starting any goroutines which use
+// recoverFatal.
+func raiseFatal() (restore func()) {
+	oldFatalf := fatalf
+	fatalf = raisef
+	return func() {
+		fatalf = oldFatalf
+	}
+}
+
+// recoverFatal runs fn returning the error passed to fatalf if it
+// was called while raiseFatal was in effect
+func recoverFatal(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	fn()
+	return nil
+}
+
+// Log if -v set
+func debugf(format string, args ...interface{}) {
+	if *verbose {
+		logf(format, args...)
+	}
+}
+
+// usage prints the syntax and exists
+func usage() {
+	BaseName := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr,
+		"Syntax: %s [flags] package_name parameter\n"+
+			"        %s describe package_name\n"+
+			"        %s generate [config_file]\n"+
+			"        %s watch [packages]\n"+
+			"        %s cover profile...\n"+
+			"        %s test package_name parameter [go test flags]\n"+
+			"        go vet -vettool=$(which %s) [packages]\n\n"+
+			"Flags:\n\n",
+		BaseName, BaseName, BaseName, BaseName, BaseName, BaseName, BaseName)
+	commandLine.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\n")
+	os.Exit(1)
+}
+
+// Main runs the gotemplate command with the arguments in os.Args
+func Main() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+
+	commandLine.Usage = usage
+	_ = commandLine.Parse(os.Args[1:])
+
+	if *jsonOutput {
+		logf = jsonLogf
+	}
+	if err := recoverFatal(run); err != nil {
+		if *jsonOutput {
+			emitError(err)
+		} else {
+			logf("%v", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command in the arguments
+func run() {
+	opts.check()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fatalf("Couldn't get wd: %v", err)
+	}
+
+	args := commandLine.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "describe":
+			if len(args) != 2 {
+				fatalf("Need 1 argument for describe, the template package")
+			}
+			describe(os.Stdout, cwd, args[1])
+			return
+		case "generate":
+			if len(args) > 2 {
+				fatalf("Need at most 1 argument for generate, the config file")
+			}
+			configFile := ""
+			if len(args) == 2 {
+				configFile = args[1]
+			}
+			generate(cwd, configFile, opts, *jobs)
+			return
+		case "watch":
+			watch(cwd, args[1:], *poll)
+			return
+		case "cover":
+			if len(args) < 2 {
+				fatalf("Need at least 1 argument for cover, the coverage profiles")
+			}
+			coverage(os.Stdout, cwd, args[1:])
+			return
+		case "test":
+			if len(args) < 3 {
+				fatalf("Need at least 2 arguments for test, package and parameters")
+			}
+			runTemplateTests(cwd, args[1], args[2], opts, generators, args[3:])
+			return
+		}
+	}
+	if len(args) != 2 {
+		fatalf("Need 2 arguments, package and parameters")
+	}
+
+	t := newTemplate(cwd, args[0], args[1])
+	opts.apply(t)
+	t.generatedFrom(os.Getenv("GOFILE"), os.Getenv("GOPACKAGE"))
+	if err := recoverFatal(t.instantiate); err != nil {
+		// Say which instance the diagnostics are for as generate does
+		e := err.(fatalError)
+		e.diagnostics = e.diagnostics.withContext("", t)
+		panic(e)
+	}
+}
@@ -0,0 +1,121 @@
+// Rules for naming the top level identifiers of an instance
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// Values for namingPolicy.export
+const (
+	exportAuto    = "auto"    // names are private if the instance name is
+	exportPublic  = "public"  // names are exported if they are in the template
+	exportPrivate = "private" // names are never exported
+)
+
+// Values for -naming
+const (
+	namingSuffix = "suffix" // add the instance name after names without the template name
+	namingPrefix = "prefix" // add the instance name before names without the template name
+)
+
+// How the top level identifiers of a template are renamed
+type namingPolicy struct {
+	prefix  bool              // put the instance name before names without the template name in
+	export  string            // one of exportAuto, exportPublic or exportPrivate
+	renames map[string]string // explicit renames which override the rules
+}
+
+// checkNaming makes sure naming is a valid naming policy
+func checkNaming(naming string) {
+	if naming != namingPrefix && naming != namingSuffix {
+		fatalf("Unknown naming policy %q - expecting %s or %s", naming, namingPrefix, namingSuffix)
+	}
+}
+
+// checkExport makes sure export is a valid export policy
+func checkExport(export string) {
+	switch export {
+	case exportAuto, exportPublic, exportPrivate:
+	default:
+		fatalf("Unknown export policy %q - expecting %s, %s or %s", export, exportAuto, exportPublic, exportPrivate)
+	}
+}
+
+// checkRenames makes sure the explicit renames are of names the
+// template declares at the top level and to valid identifiers
+func (p *namingPolicy) checkRenames(declared map[string]bool) {
+	var names []string
+	for from := range p.renames {
+		names = append(names, from)
+	}
+	sort.Strings(names)
+	for _, from := range names {
+		if to := p.renames[from]; !token.IsIdentifier(to) {
+			fatalf("Can't rename %s to %q as it isn't an identifier", from, to)
+		}
+		if !declared[from] {
+			fatalf("Can't rename %s as the template doesn't declare it at the top level", from)
+		}
+	}
+}
+
+// capitalize returns name with its first letter in upper case
+func capitalize(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// setExported returns name with its first letter in upper case if
+// exported is set or lower case if not
+func setExported(name string, exported bool) string {
+	if exported {
+		return capitalize(name)
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// rename returns the name the top level identifier name in the
+// template called templateName gets in the instance called
+// instanceName
+func (p *namingPolicy) rename(name, templateName, instanceName string) string {
+	if to, ok := p.renames[name]; ok {
+		debugf("Renaming '%s' to '%s' as requested", name, to)
+		return to
+	}
+	replacementName := ""
+	if !strings.Contains(name, templateName) {
+		// If name doesn't contain template name then just add
+		// the instance name to it
+		if p.prefix {
+			// Keep unexported names unexported
+			replacementName = setExported(instanceName+capitalize(name), ast.IsExported(name))
+		} else {
+			replacementName = name + capitalize(instanceName)
+		}
+		debugf("Top level definition '%s' doesn't contain template name '%s', using '%s'", name, templateName, replacementName)
+	} else {
+		// make sure the new identifier will follow
+		// Go casing style (newMySet not newmySet).
+		innerName := instanceName
+		if strings.Index(name, templateName) != 0 {
+			innerName = capitalize(innerName)
+		}
+		replacementName = strings.Replace(name, templateName, innerName, 1)
+	}
+	switch p.export {
+	case exportPublic:
+		replacementName = setExported(replacementName, ast.IsExported(name))
+	case exportPrivate:
+		replacementName = setExported(replacementName, false)
+	default:
+		// If new template name is not public then make sure
+		// the exported name is not public too
+		if !ast.IsExported(instanceName) {
+			replacementName = setExported(replacementName, false)
+		}
+	}
+	return replacementName
+}
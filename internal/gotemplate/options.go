@@ -0,0 +1,107 @@
+// Options which can be set for each instantiation
+
+package gotemplate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The options for an instantiation which can be set with flags
+type options struct {
+	outfile         string
+	test            bool
+	bundle          bool
+	shared          bool
+	collisionSuffix string
+	naming          string
+	export          string
+	updateLock      bool
+	cache           bool
+	lineDirectives  bool
+	typeCheck       bool
+	force           bool
+	renames         renameFlag
+	imports         renameFlag
+}
+
+// newOptions makes options with the flags added to fs
+func newOptions(fs *flag.FlagSet) *options {
+	o := &options{renames: renameFlag{}, imports: renameFlag{}}
+	fs.StringVar(&o.outfile, "outfmt", defaultOutputFormat, "the format of the output file; must contain a single instance of the %v verb\n"+
+		"\twhich will be replaced with the template instance name")
+	fs.BoolVar(&o.test, "test", false, "Write the instance to a _test.go file so it is only used by the tests - the default for directives in _test.go files")
+	fs.BoolVar(&o.bundle, "bundle", false, "Write the instances from the directives in each file to one file named after it")
+	fs.BoolVar(&o.shared, "shared", false, "Write helpers which don't use the template parameters to a file shared by all instances")
+	fs.StringVar(&o.collisionSuffix, "collision-suffix", "", "Suffix to add to names which collide with ones already in the package")
+	fs.StringVar(&o.naming, "naming", namingSuffix, "Whether to add the instance name as a prefix or suffix to names without the template name in")
+	fs.StringVar(&o.export, "export", exportAuto, "Which names are exported: auto - only if the instance name is, public - if they are in the template, private - never")
+	fs.BoolVar(&o.updateLock, "update-lock", false, "Update "+lockFileName+" if the templates have changed, creating it if necessary")
+	fs.BoolVar(&o.cache, "cache", false, "Reuse the results of previous identical instantiations from the user's cache directory")
+	fs.BoolVar(&o.lineDirectives, "line-directives", false, "Add //line comments so errors and stack traces point at the template")
+	fs.BoolVar(&o.typeCheck, "check", true, "Type check the instance in the destination package and don't write it if it has errors")
+	fs.BoolVar(&o.force, "force", false, "Write the instance even if it has type errors, reporting them as warnings")
+	fs.Var(o.renames, "rename", "Rename a top level identifier of the template, eg -rename utilityFunc=helper - can be repeated")
+	fs.Var(o.imports, "import", "Import a package the arguments use, eg -import model=github.com/org/app/model - can be repeated")
+	return o
+}
+
+// check makes sure the options are valid
+func (o *options) check() {
+	checkOutputFormat(o.outfile)
+	checkNaming(o.naming)
+	checkExport(o.export)
+}
+
+// apply sets the options for t
+func (o *options) apply(t *template) {
+	t.outputFormat = o.outfile
+	t.testOutput = o.test
+	t.bundle = o.bundle
+	t.shareHelpers = o.shared
+	t.collisionSuffix = o.collisionSuffix
+	t.naming.prefix = o.naming == namingPrefix
+	t.naming.export = o.export
+	for from, to := range o.renames {
+		t.naming.renames[from] = to
+	}
+	for alias, importPath := range o.imports {
+		t.importFlags[alias] = importPath
+	}
+	t.updateLock = o.updateLock
+	t.cache = o.cache
+	t.lineDirectives = o.lineDirectives
+	t.typeCheck = o.typeCheck
+	t.force = o.force
+	lockFile := filepath.Join(t.Dir, lockFileName)
+	if _, err := os.Stat(lockFile); err == nil || t.updateLock {
+		t.lockFile = lockFile
+	}
+}
+
+// renameFlag collects the -rename old=new flags
+type renameFlag map[string]string
+
+// String turns the flag into a string
+func (r renameFlag) String() string {
+	var s []string
+	for from, to := range r {
+		s = append(s, from+"="+to)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// Set parses a single old=new rename
+func (r renameFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expecting old=new but got %q", value)
+	}
+	r[value[:i]] = value[i+1:]
+	return nil
+}
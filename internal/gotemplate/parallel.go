@@ -0,0 +1,122 @@
+// Runs instantiations in parallel
+
+package gotemplate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// Mutexes for files which more than one instantiation may update
+var fileMutexes = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockPath stops any other instantiation updating fileName until the
+// returned function is called
+func lockPath(fileName string) (unlock func()) {
+	fileMutexes.Lock()
+	mu := fileMutexes.m[fileName]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		fileMutexes.m[fileName] = mu
+	}
+	fileMutexes.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// parallel calls fn for each of 0..n-1 using at most jobs goroutines
+// at once, returning when they have all finished
+func parallel(jobs, n int, fn func(i int)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs && j < n; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// instantiateAll instantiates the templates using at most jobs at
+// once, returning the error for each one which failed
+//
+// Each template sees the files the others write as they were before
+// any of them ran so the output is the same whatever order they run
+// in.  The instances whose output doesn't exist yet are then
+// instantiated one at a time so each sees the names declared by the
+// others and clashes between them are found before they are written.
+func instantiateAll(templates []*template, jobs int) []error {
+	fresh := snapshotOutputs(templates)
+	errs := make([]error, len(templates))
+	defer raiseFatal()()
+	var existing []int
+	for i := range templates {
+		if !fresh[i] {
+			existing = append(existing, i)
+		}
+	}
+	parallel(jobs, len(existing), func(j int) {
+		i := existing[j]
+		errs[i] = recoverFatal(templates[i].instantiate)
+	})
+	for i, t := range templates {
+		if fresh[i] {
+			// Nothing else is writing so read the files as they are
+			t.overlay = nil
+			errs[i] = recoverFatal(t.instantiate)
+		}
+	}
+	return errs
+}
+
+// snapshotOutputs sets the overlay of each template to the current
+// contents of the files the other templates and the shared helpers
+// are written to in the same directory, returning which templates
+// are writing an output which doesn't exist yet
+func snapshotOutputs(templates []*template) []bool {
+	snapshot := map[string][]byte{}
+	missingFiles := map[string]bool{}
+	read := func(fileName, missing string) bool {
+		if _, found := snapshot[fileName]; !found {
+			b, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				b = []byte(missing)
+				missingFiles[fileName] = true
+			}
+			snapshot[fileName] = b
+		}
+		return missingFiles[fileName]
+	}
+	fresh := make([]bool, len(templates))
+	for i, t := range templates {
+		fresh[i] = read(filepath.Join(t.Dir, t.outputFileName()), "package "+t.NewPackage+"\n")
+		shared, _ := filepath.Glob(filepath.Join(t.Dir, sharedFileName("*")))
+		for _, fileName := range shared {
+			read(fileName, "")
+		}
+	}
+	for _, t := range templates {
+		t.overlay = map[string][]byte{}
+		for fileName, b := range snapshot {
+			if filepath.Dir(fileName) == filepath.Clean(t.Dir) {
+				t.overlay[fileName] = b
+			}
+		}
+	}
+	return fresh
+}
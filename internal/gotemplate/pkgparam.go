@@ -0,0 +1,102 @@
+// Template parameters which are packages
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/build"
+	"go/types"
+	"path"
+	"regexp"
+	"strconv"
+)
+
+// "pkg clock" in a template definition
+var matchPkgParam = regexp.MustCompile(`\bpkg\s+(\w+)`)
+
+// parsePkgParams replaces the "pkg name" parameters in the template
+// definition s with just their names, returning those names
+func parsePkgParams(s string) (string, map[string]bool) {
+	pkgParams := map[string]bool{}
+	s = matchPkgParam.ReplaceAllStringFunc(s, func(param string) string {
+		name := matchPkgParam.FindStringSubmatch(param)[1]
+		pkgParams[name] = true
+		return name
+	})
+	return s, pkgParams
+}
+
+// pkgArg returns the import path from the argument for the package
+// parameter name
+func pkgArg(name, arg string) string {
+	importPath, err := strconv.Unquote(arg)
+	if err != nil || importPath == "" {
+		fatalf("Argument %s for package parameter %s must be a quoted import path", arg, name)
+	}
+	return importPath
+}
+
+// importName returns the name the package imported by spec is
+// referred to by in the file
+func importName(spec *ast.ImportSpec, info *types.Info) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	if obj := info.Implicits[spec]; obj != nil {
+		return obj.Name()
+	}
+	return ""
+}
+
+// replacePkgParams points the imports of the stub packages named by
+// the package parameters at the argument packages.
+//
+// The references to the package are renamed to the name of the
+// argument package if it can be found and doesn't clash with another
+// import, otherwise the import is given the parameter name.
+func (t *template) replacePkgParams(f *ast.File, info *types.Info) {
+	if len(t.pkgArgs) == 0 {
+		return
+	}
+	names := map[string]bool{}
+	for _, spec := range f.Imports {
+		names[importName(spec, info)] = true
+	}
+	found := map[string]bool{}
+	for _, spec := range f.Imports {
+		param := importName(spec, info)
+		importPath, ok := t.pkgArgs[param]
+		if !ok {
+			continue
+		}
+		found[param] = true
+		obj := info.Defs[spec.Name]
+		if obj == nil {
+			obj = info.Implicits[spec]
+		}
+		t.pkgParamObjs[obj] = true
+		spec.Path.Value = strconv.Quote(importPath)
+
+		newName := param
+		if p, err := build.Default.Import(importPath, t.Dir, build.ImportMode(0)); err != nil {
+			debugf("Couldn't find package %q so importing it as %s: %v", importPath, param, err)
+		} else if p.Name != param && names[p.Name] {
+			debugf("Package %q clashes with another import so importing it as %s", importPath, param)
+		} else {
+			newName = p.Name
+		}
+		if newName != param {
+			t.mappings[obj] = newName
+		}
+		if newName == path.Base(importPath) {
+			spec.Name = nil
+		} else {
+			spec.Name = ast.NewIdent(newName)
+		}
+	}
+	for param := range t.pkgArgs {
+		if !found[param] {
+			fatalf("Didn't find an import for package parameter %s in %s", param, t.inputFile)
+		}
+	}
+}
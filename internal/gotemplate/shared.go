@@ -0,0 +1,336 @@
+// Shares helpers which don't depend on the template parameters
+// between all the instantiations of a template in a package
+
+package gotemplate
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// "//gotemplate:users gotemplate_MySet.go gotemplate_YourSet.go"
+var matchSharedUsers = regexp.MustCompile(`^//gotemplate:users\s+(.*?)\s*$`)
+
+// "//gotemplate:template github.com/ncw/gotemplate/set"
+var matchSharedTemplate = regexp.MustCompile(`^//gotemplate:template\s+(.*?)\s*$`)
+
+// A helper in the shared file along with the output files using it
+type sharedHelper struct {
+	doc   string
+	decl  string
+	users []string
+}
+
+// sharedFileName returns the name of the file holding the helpers
+// shared by all the instantiations of templateName
+func sharedFileName(templateName string) string {
+	return "gotemplate_shared_" + templateName + ".go"
+}
+
+// sharedName returns the name used for a shared helper
+//
+// This mustn't depend on the instance name so all the instances can
+// use it.
+func sharedName(name, templateName string) string {
+	return name + "Shared" + capitalize(templateName)
+}
+
+// findSharedHelpers returns the unexported functions in f which
+// don't refer to the template parameters, including package
+// parameters, or to any top level declaration which can't be shared
+// itself.
+//
+// Methods, types, vars and consts are never shared - a var is state
+// belonging to the instance and a type would need its methods too.
+func (t *template) findSharedHelpers(f *ast.File, info *types.Info, pkg *types.Package) map[types.Object]*ast.FuncDecl {
+	helpers := map[types.Object]*ast.FuncDecl{}
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Recv != nil || d.Name.Name == "init" || ast.IsExported(d.Name.Name) {
+			continue
+		}
+		if _, ok := t.templateArgsMap[d.Name.Name]; ok {
+			continue
+		}
+		// Helpers with directives are named per instance
+		if _, ok := t.declDirectives[info.Defs[d.Name]]; ok {
+			continue
+		}
+		helpers[info.Defs[d.Name]] = d
+	}
+
+	// Throw out any helpers which use top level declarations
+	// which aren't helpers until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for obj, d := range helpers {
+			ast.Inspect(d, func(n ast.Node) bool {
+				id, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				used := info.Uses[id]
+				if t.pkgParamObjs[used] {
+					delete(helpers, obj)
+					changed = true
+					return false
+				}
+				if used == nil || used.Pkg() != pkg || used.Parent() != pkg.Scope() {
+					return true
+				}
+				if _, ok := helpers[used]; !ok {
+					delete(helpers, obj)
+					changed = true
+					return false
+				}
+				return true
+			})
+		}
+	}
+	return helpers
+}
+
+// removeComments removes the comments between from and to in f
+func removeComments(f *ast.File, from, to token.Pos) {
+	comments := f.Comments[:0]
+	for _, cg := range f.Comments {
+		if cg.Pos() < from || cg.End() > to {
+			comments = append(comments, cg)
+		}
+	}
+	f.Comments = comments
+}
+
+// splitHelper returns the doc comment, without any users directive,
+// and the source of the function d
+func splitHelper(fset *token.FileSet, f *ast.File, d *ast.FuncDecl) (doc string, decl string, users []string) {
+	if d.Doc != nil {
+		for _, c := range d.Doc.List {
+			if matches := matchSharedUsers.FindStringSubmatch(c.Text); matches != nil {
+				users = strings.Fields(matches[1])
+			} else {
+				doc += c.Text + "\n"
+			}
+		}
+	}
+	savedDoc := d.Doc
+	d.Doc = nil
+	defer func() { d.Doc = savedDoc }()
+	var buf bytes.Buffer
+	err := format.Node(&buf, fset, &printer.CommentedNode{Node: d, Comments: f.Comments})
+	if err != nil {
+		fatalf("Failed to format shared helper: %v", err)
+	}
+	return doc, buf.String(), users
+}
+
+// readSharedFile reads the helpers out of an existing shared file
+// along with the import path of the template they came from, if
+// recorded
+func readSharedFile(fileName string) (helpers map[string]*sharedHelper, templatePath string) {
+	helpers = map[string]*sharedHelper{}
+	src, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return helpers, ""
+	} else if err != nil {
+		fatalf("Cannot open existing file: %v", err)
+	}
+	fset, f := parseFile(fileName, src)
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matches := matchSharedTemplate.FindStringSubmatch(c.Text); matches != nil {
+				templatePath = matches[1]
+			}
+		}
+	}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok {
+			doc, text, users := splitHelper(fset, f, d)
+			helpers[d.Name.Name] = &sharedHelper{doc: doc, decl: text, users: users}
+		}
+	}
+	return helpers, templatePath
+}
+
+// readShared locks the shared file of the template and reads the
+// helpers in it, forgetting that the instance written to
+// outputFileName uses any of them.
+//
+// Output files which no longer exist are dropped from the users, so
+// deleting an instance prunes its helpers on the next run.
+//
+// The shared file is named after the template so two template
+// packages with the same template name can't both share their
+// helpers in one package, which is an error.
+//
+// No other instantiation can update the shared file until unlock is
+// called.
+func (t *template) readShared(outputFileName string) (fileName string, helpers map[string]*sharedHelper, unlock func()) {
+	fileName = filepath.Join(t.Dir, sharedFileName(t.templateName))
+	unlock = lockPath(fileName)
+	done := false
+	defer func() {
+		// Don't leave it locked if there was a fatal error
+		if !done {
+			unlock()
+		}
+	}()
+	helpers, templatePath := readSharedFile(fileName)
+	if templatePath != "" && templatePath != t.templatePath {
+		fatalf("%q holds the helpers shared by the template %s from %q so can't share those of %s from %q - don't use -shared for one of them",
+			sharedFileName(t.templateName), t.templateName, templatePath, t.templateName, t.templatePath)
+	}
+	for _, helper := range helpers {
+		users := helper.users[:0]
+		for _, user := range helper.users {
+			if user == outputFileName {
+				continue
+			}
+			// Instances generated at the same time may not have
+			// been written yet
+			userFile := filepath.Join(t.Dir, user)
+			_, generating := t.overlay[userFile]
+			if _, err := os.Stat(userFile); err != nil && !generating {
+				debugf("Dropping %q from users of shared helpers: %v", user, err)
+				continue
+			}
+			users = append(users, user)
+		}
+		helper.users = users
+	}
+	done = true
+	return fileName, helpers, unlock
+}
+
+// sameSource returns whether the sources of two declarations are
+// the same once formatted
+func sameSource(a, b string) bool {
+	if a == b {
+		return true
+	}
+	fa, errA := format.Source([]byte(a))
+	fb, errB := format.Source([]byte(b))
+	return errA == nil && errB == nil && bytes.Equal(fa, fb)
+}
+
+// unshareDifferent returns the helpers in decls which can be shared
+// with the other instances using helpers.
+//
+// A helper whose source differs from the one of the same name the
+// other instances share, eg because it came from a specialization,
+// is kept in the instance with its name from ownNames instead, as
+// are the helpers which use it.
+func (t *template) unshareDifferent(fset *token.FileSet, f *ast.File, info *types.Info, decls []*ast.FuncDecl, helpers map[string]*sharedHelper, ownNames map[*ast.FuncDecl]string) []*ast.FuncDecl {
+	unshared := map[types.Object]bool{}
+	for _, d := range decls {
+		helper := helpers[d.Name.Name]
+		if helper == nil || len(helper.users) == 0 {
+			continue
+		}
+		if _, text, _ := splitHelper(fset, f, d); !sameSource(text, helper.decl) {
+			debugf("Not sharing %s as it differs from the one in %s", d.Name.Name, strings.Join(helper.users, ", "))
+			unshared[info.Defs[d.Name]] = true
+		}
+	}
+	for changed := len(unshared) > 0; changed; {
+		changed = false
+		for _, d := range decls {
+			obj := info.Defs[d.Name]
+			if unshared[obj] {
+				continue
+			}
+			ast.Inspect(d.Body, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok && unshared[info.Uses[id]] {
+					unshared[obj] = true
+					changed = true
+				}
+				return !unshared[obj]
+			})
+		}
+	}
+	var shared []*ast.FuncDecl
+	for _, d := range decls {
+		obj := info.Defs[d.Name]
+		if !unshared[obj] {
+			shared = append(shared, d)
+			continue
+		}
+		t.mappings[obj] = ownNames[d]
+		replaceIdentifier(f, info, obj, ownNames[d])
+	}
+	return shared
+}
+
+// mergeShared merges the helpers in decls used by the instance
+// written to outputFileName into the helpers from readShared,
+// returning the new contents of the shared file, or nil if it should
+// be removed, for writeShared.
+//
+// Each helper records the output files which use it so that a
+// helper is only removed once no instance needs it.
+func (t *template) mergeShared(fset *token.FileSet, f *ast.File, decls []*ast.FuncDecl, helpers map[string]*sharedHelper, fileName, outputFileName string) []byte {
+	for _, d := range decls {
+		doc, text, _ := splitHelper(fset, f, d)
+		helper := helpers[d.Name.Name]
+		if helper == nil {
+			helper = &sharedHelper{}
+			helpers[d.Name.Name] = helper
+		}
+		helper.doc = doc
+		helper.decl = text
+		helper.users = append(helper.users, outputFileName)
+	}
+
+	names := []string{}
+	for name, helper := range helpers {
+		if len(helper.users) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	b := new(bytes.Buffer)
+	b.WriteString(genHeader)
+	b.WriteString("package " + t.NewPackage + "\n\n")
+	b.WriteString("//gotemplate:template " + t.templatePath + "\n\n")
+	for _, name := range names {
+		helper := helpers[name]
+		sort.Strings(helper.users)
+		b.WriteString(helper.doc)
+		b.WriteString("//gotemplate:users " + strings.Join(helper.users, " ") + "\n")
+		b.WriteString(helper.decl)
+		b.WriteString("\n\n")
+	}
+	bts, err := imports.Process(fileName, b.Bytes(), nil)
+	if err != nil {
+		fatalf("Cannot fix imports: %v", err)
+	}
+	return bts
+}
+
+// writeShared writes the shared file made by mergeShared, removing it
+// if src is nil
+func writeShared(fileName string, src []byte) {
+	if src == nil {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			fatalf("Failed to remove %q: %v", fileName, err)
+		}
+		return
+	}
+	writeFile(fileName, src)
+}
@@ -0,0 +1,133 @@
+// Specializations of templates for particular arguments
+
+package gotemplate
+
+import (
+	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// "template specialize Set(bool)"
+var matchTemplateSpecialize = regexp.MustCompile(`^//\s*template\s+specialize\s+(\w+\s*.*?)\s*$`)
+
+// specializationScore returns how many of the patterns match the
+// arguments exactly or -1 if the patterns don't match. A pattern of
+// "_" matches any argument.
+func specializationScore(patterns, args []string) int {
+	if len(patterns) != len(args) {
+		return -1
+	}
+	score := 0
+	for i, pattern := range patterns {
+		if pattern == "_" {
+			continue
+		}
+		if pattern != args[i] {
+			return -1
+		}
+		score++
+	}
+	return score
+}
+
+// removeBuildConstraints removes the build constraints which keep a
+// specialization out of the build of the template package
+func removeBuildConstraints(f *ast.File) {
+	comments := f.Comments[:0]
+	for _, cg := range f.Comments {
+		if cg.Pos() < f.Package && isBuildConstraint(cg) {
+			continue
+		}
+		comments = append(comments, cg)
+	}
+	f.Comments = comments
+}
+
+// isBuildConstraint returns whether cg consists only of build
+// constraints
+func isBuildConstraint(cg *ast.CommentGroup) bool {
+	for _, c := range cg.List {
+		if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// templateName returns the name from the "template type" directive
+// in f or "" if there isn't one
+func templateName(f *ast.File) string {
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matches := matchTemplateType.FindStringSubmatch(c.Text); matches != nil {
+				name, _ := parseTemplateAndArgs(matches[1])
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// A "template specialize" directive
+type specialization struct {
+	filePath string   // file it was found in
+	spec     string   // as written, eg "Set(bool)"
+	patterns []string // the arguments it matches
+}
+
+// findSpecializations looks through the files in the template package
+// which are excluded from the build for "template specialize"
+// directives
+func findSpecializations(p *build.Package) []specialization {
+	var specializations []specialization
+	for _, name := range p.IgnoredGoFiles {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		filePath := path.Join(p.Dir, name)
+		_, f := parseFile(filePath, nil)
+		for _, cg := range f.Comments {
+			for _, c := range cg.List {
+				matches := matchTemplateSpecialize.FindStringSubmatch(c.Text)
+				if matches == nil {
+					continue
+				}
+				specName, patterns := parseTemplateAndArgs(matches[1])
+				if specName != templateName(f) {
+					fatalf("Specialization %q in %s doesn't match the template definition", matches[1], filePath)
+				}
+				specializations = append(specializations, specialization{
+					filePath: filePath,
+					spec:     matches[1],
+					patterns: patterns,
+				})
+			}
+		}
+	}
+	return specializations
+}
+
+// findSpecialization finds the specialization matching the arguments
+//
+// It returns the path of the most specific match or "" if there
+// isn't one.
+func (t *template) findSpecialization(p *build.Package) string {
+	best, bestScore, ambiguous := "", -1, false
+	for _, s := range findSpecializations(p) {
+		score := specializationScore(s.patterns, t.Args)
+		debugf("Specialization %q in %s scores %d", s.spec, path.Base(s.filePath), score)
+		if score < 0 || score < bestScore {
+			continue
+		}
+		ambiguous = score == bestScore
+		best, bestScore = s.filePath, score
+	}
+	if ambiguous {
+		fatalf("More than one specialization of %q matches %s(%s) equally well", t.Package, t.Name, strings.Join(t.Args, ", "))
+	}
+	return best
+}
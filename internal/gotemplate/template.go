@@ -0,0 +1,1059 @@
+// Reads the templates and writes the substituted templates
+
+package gotemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+var testingMode = false
+
+const (
+	genHeader           = "// Code generated by gotemplate. DO NOT EDIT.\n\n"
+	defaultOutputFormat = "gotemplate_%v"
+)
+
+// Holds the desired template
+type template struct {
+	Package         string
+	Name            string
+	Args            []string
+	NewPackage      string
+	Dir             string
+	templateName    string
+	templateArgs    []string
+	templateArgsMap map[string]string
+	mappings        map[types.Object]string
+	inputFile       string
+	outputFormat    string                         // format of the output file name without the .go
+	outputFile      string                         // name of the output file if set
+	testOutput      bool                           // write the instance to a _test.go file
+	bundle          bool                           // write the instance into a file with others
+	bundleName      string                         // name of the bundle used for its file name
+	bundleFrom      string                         // file with the directives making the bundle
+	bundleInstances map[string]bool                // instances in the bundle from the config file
+	lockFile        string                         // path of the lock file if using one
+	updateLock      bool                           // update the lock file if the template has changed
+	shareHelpers    bool                           // move the helpers not using the parameters to the shared file
+	templatePath    string                         // import path of the template package
+	cache           bool                           // use the cache of instantiation results
+	lineDirectives  bool                           // add //line comments pointing at the template
+	dryRun          bool                           // don't write any files
+	typeCheck       bool                           // type check the instance in the destination package before writing it
+	force           bool                           // write the instance even if it doesn't type check
+	declPositions   []token.Position               // template positions of the instance's top level declarations
+	usesDestination bool                           // set if the output depends on the destination package
+	specialized     bool                           // the template file is a specialization for the arguments
+	variadic        bool                           // the last template parameter takes a list of arguments
+	variadicParam   string                         // name of the variadic parameter
+	variadicArgs    []string                       // arguments for the variadic parameter
+	variadicObj     types.Object                   // definition of the variadic parameter in the template
+	collisionSuffix string                         // appended to names colliding with the destination package
+	naming          namingPolicy                   // how the names in the template are mangled
+	declDirectives  map[types.Object]declDirective // directives on the top level declarations
+	pkgArgs         map[string]string              // import paths of the package parameters
+	pkgParamObjs    map[types.Object]bool          // imports of the package parameters in the template
+	importFlags     map[string]string              // packages the arguments use by name from -import
+	argImports      map[string]string              // packages the arguments use by the name they are imported as
+	destPkg         *packages.Package              // the destination package, once loaded
+	destNames       map[string]token.Position      // top level names declared in the destination package
+	destImports     map[string]bool                // imports of the destination package as "name path"
+	argTypes        map[string]types.Type          // types of the arguments looked up in destPkg
+	argErrors       diagnostics                    // problems found with the arguments
+	overlay         map[string][]byte              // contents to use for other files in the destination package
+	withTests       bool                           // instantiate the template's tests too
+	generators      map[string]string              // functions making test values to use instead of the template's
+	testFset        *token.FileSet                 // positions of testSyntax
+	testSyntax      []*ast.File                    // the template's test files
+}
+
+// importDir reads the go files in dir, which may only be test files
+func importDir(dir string) *build.Package {
+	p, err := build.Default.ImportDir(dir, build.ImportMode(0))
+	if _, noGo := err.(*build.NoGoError); noGo && p.Name != "" {
+		// Only test files
+		err = nil
+	}
+	if err != nil {
+		fatalf("Failed to read packages in %q: %v", dir, err)
+	}
+	return p
+}
+
+// findPackageName reads all the go packages in dir and finds which
+// package they are in
+func findPackageName(dir string) string {
+	return importDir(dir).Name
+}
+
+// findTestPackageName finds which package the test files in dir are
+// in - the external test package if dir only has external tests,
+// otherwise the package itself
+func findTestPackageName(dir string) string {
+	p := importDir(dir)
+	if len(p.XTestGoFiles) > 0 && len(p.TestGoFiles) == 0 {
+		return p.Name + "_test"
+	}
+	return p.Name
+}
+
+// filePackageName reads the package clause of fileName
+func filePackageName(fileName string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), fileName, nil, parser.PackageClauseOnly)
+	if err != nil {
+		fatalf("Failed to read the package of %q: %v", fileName, err)
+	}
+	return f.Name.Name
+}
+
+// checkOutputFormat verifies that format contains exactly one
+// occurrence of the %v verb and no other occurences of %
+func checkOutputFormat(format string) {
+	if c := strings.Replace(format, "%v", "", 1); c == format ||
+		strings.Index(c, "%") != -1 {
+
+		fatalf("Invalid outfile format %q", format)
+	}
+}
+
+// init the template instantiation into the package in dir
+func newTemplate(dir, pkg, templateArgsString string) *template {
+	return newTemplateInPackage(dir, pkg, templateArgsString, findPackageName(dir))
+}
+
+// init the template instantiation into the package called newPackage
+// in dir
+func newTemplateInPackage(dir, pkg, templateArgsString, newPackage string) *template {
+	name, templateArgs := parseTemplateAndArgs(templateArgsString)
+	return &template{
+		Package:         pkg,
+		Name:            name,
+		Args:            templateArgs,
+		Dir:             dir,
+		outputFormat:    defaultOutputFormat,
+		mappings:        make(map[types.Object]string),
+		NewPackage:      newPackage,
+		templateArgsMap: make(map[string]string),
+		pkgArgs:         make(map[string]string),
+		pkgParamObjs:    make(map[types.Object]bool),
+		importFlags:     make(map[string]string),
+		declDirectives:  make(map[types.Object]declDirective),
+		naming: namingPolicy{
+			export:  exportAuto,
+			renames: make(map[string]string),
+		},
+	}
+}
+
+// Add a mapping for identifier
+//
+// The directives on the declaration are used unless it has been
+// renamed explicitly
+func (t *template) addMapping(object types.Object, name string) {
+	d := t.declDirectives[object]
+	if _, renamed := t.naming.renames[name]; renamed || d == (declDirective{}) {
+		t.mappings[object] = t.naming.rename(name, t.templateName, t.Name)
+		return
+	}
+	replacementName := name
+	if d.name != "" {
+		replacementName = d.expandName(t.Name)
+	} else if !d.keep {
+		replacementName = t.naming.rename(name, t.templateName, t.Name)
+	}
+	if d.private {
+		replacementName = setExported(replacementName, false)
+	}
+	debugf("Directives %q on '%s' give '%s'", d, name, replacementName)
+	t.mappings[object] = replacementName
+}
+
+// Parse the arguments string Template(A, B, C)
+func parseTemplateAndArgs(s string) (name string, args []string) {
+	name, args, variadic := parseTemplateCall(s)
+	if variadic {
+		fatalf("Failed to parse %q: unexpected ...", s)
+	}
+	return name, args
+}
+
+// Parse the template definition Template(A, B, C...)
+//
+// variadic is set if the last parameter takes a list of arguments
+// and pkgParams holds the parameters declared as "pkg name"
+func parseTemplateDefinition(s string) (name string, params []string, variadic bool, pkgParams map[string]bool) {
+	def, pkgParams := parsePkgParams(s)
+	name, params, variadic = parseTemplateCall(def)
+	for _, param := range params {
+		if !token.IsIdentifier(param) {
+			fatalf("Failed to parse %q: expecting identifier for parameter but got %q", s, param)
+		}
+	}
+	if variadic && pkgParams[params[len(params)-1]] {
+		fatalf("Failed to parse %q: package parameters can't be variadic", s)
+	}
+	return name, params, variadic, pkgParams
+}
+
+// Parse Template(A, B, C) into name and args and whether the last
+// argument has ... after it
+func parseTemplateCall(s string) (name string, args []string, ellipsis bool) {
+	src, importPaths := replaceImportPaths(s)
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		fatalf("Failed to parse %q: %v", s, err)
+	}
+	debugf("expr = %#v\n", expr)
+	callExpr, ok := expr.(*ast.CallExpr)
+	if !ok {
+		fatalf("Failed to parse %q: expecting Identifier(...)", s)
+	}
+	debugf("fun = %#v", callExpr.Fun)
+	fn, ok := callExpr.Fun.(*ast.Ident)
+	if !ok {
+		fatalf("Failed to parse %q: expecting Identifier(...)", s)
+	}
+	name = fn.Name
+	for i, arg := range callExpr.Args {
+		var buf bytes.Buffer
+		debugf("arg[%d] = %#v", i, arg)
+		err = format.Node(&buf, token.NewFileSet(), arg)
+		if err != nil {
+			fatalf("Failed to format %q: %v", s, err)
+		}
+		s := restoreImportPaths(buf.String(), importPaths)
+		debugf("parsed = %q", s)
+		args = append(args, s)
+	}
+	ellipsis = callExpr.Ellipsis.IsValid()
+	return
+}
+
+// "template type Set(A)"
+var matchTemplateType = regexp.MustCompile(`^//\s*template\s+type\s+(\w+\s*.*?)\s*$`)
+
+func (t *template) findTemplateDefinition(f *ast.File) {
+	// Inspect the comments
+	t.templateName = ""
+	t.templateArgs = nil
+	var pkgParams map[string]bool
+	for _, cg := range f.Comments {
+		for _, x := range cg.List {
+			matches := matchTemplateType.FindStringSubmatch(x.Text)
+			if matches != nil {
+				if t.templateName != "" {
+					fatalf("Found multiple template definitions in %s", t.inputFile)
+				}
+				t.templateName, t.templateArgs, t.variadic, pkgParams = parseTemplateDefinition(matches[1])
+			}
+		}
+	}
+	if t.templateName == "" {
+		fatalf("Didn't find template definition in %s", t.inputFile)
+	}
+	params := t.templateArgs
+	if t.variadic {
+		params = params[:len(params)-1]
+		if len(t.Args) < len(params) {
+			fatalf("Wrong number of arguments - template is expecting at least %d but %d supplied", len(params), len(t.Args))
+		}
+		t.variadicParam = t.templateArgs[len(params)]
+		t.variadicArgs = t.Args[len(params):]
+	} else if len(t.templateArgs) != len(t.Args) {
+		fatalf("Wrong number of arguments - template is expecting %d but %d supplied", len(t.templateArgs), len(t.Args))
+	}
+	for i, from := range params {
+		if pkgParams[from] {
+			t.pkgArgs[from] = pkgArg(from, t.Args[i])
+		} else {
+			t.templateArgsMap[from] = t.Args[i]
+		}
+	}
+	t.qualifyArgs(f)
+	debugf("templateName = %v, templateArgs = %v", t.templateName, t.templateArgs)
+}
+
+// removeParam records what the definition def of a template
+// parameter should be replaced with, returning false if name isn't a
+// template parameter
+func (t *template) removeParam(name string, def types.Object) bool {
+	if t.variadic && name == t.variadicParam {
+		t.variadicObj = def
+		return true
+	}
+	to, ok := t.templateArgsMap[name]
+	if ok {
+		t.mappings[def] = to
+	}
+	return ok
+}
+
+// renameTypeParams renames the type parameters of the generic
+// declarations in f and the tests which would capture a name the
+// arguments or the instance use, eg T in "func mapSlice[T any](xs []A)"
+// with the argument T, to one not declared in the destination package
+func (t *template) renameTypeParams(f *ast.File, info *types.Info) {
+	avoid := map[string]bool{}
+	args := append(append([]string{}, t.Args...), t.variadicArgs...)
+	for _, arg := range t.templateArgsMap {
+		args = append(args, arg)
+	}
+	for _, arg := range args {
+		if expr, err := parser.ParseExpr(arg); err == nil {
+			ast.Inspect(expr, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					avoid[id.Name] = true
+				}
+				return true
+			})
+		}
+	}
+	for _, name := range t.mappings {
+		avoid[name] = true
+	}
+
+	var params []*types.TypeName
+	for id, obj := range info.Defs {
+		if tn, ok := obj.(*types.TypeName); ok && avoid[id.Name] {
+			if _, ok := tn.Type().(*types.TypeParam); ok {
+				params = append(params, tn)
+			}
+		}
+	}
+	if len(params) == 0 {
+		return
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Pos() < params[j].Pos() })
+
+	// The new names mustn't be used anywhere else either
+	used := map[string]bool{}
+	for name := range t.destinationNames() {
+		used[name] = true
+	}
+	for _, file := range append([]*ast.File{f}, t.testSyntax...) {
+		ast.Inspect(file, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+			return true
+		})
+	}
+	for _, tn := range params {
+		name := tn.Name()
+		for i := 2; avoid[name] || used[name]; i++ {
+			name = fmt.Sprintf("%s%d", tn.Name(), i)
+		}
+		debugf("Renaming type parameter %s to %s to avoid capturing the instance's %s", tn.Name(), name, tn.Name())
+		t.mappings[tn] = name
+	}
+}
+
+// Parses a file into a Fileset and Ast
+//
+// Dies with a fatal error on error
+func parseFile(path string, src interface{}) (*token.FileSet, *ast.File) {
+	fset := token.NewFileSet() // positions are relative to fset
+	f, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		fatalf("Failed to parse file: %s", err)
+	}
+	return fset, f
+}
+
+// Replace the identifers in f
+func replaceIdentifier(f *ast.File, info *types.Info, old types.Object, new string) {
+	// We replace the identifier name with a string
+	// which is a bit untidy if we weren't
+	// replacing with an identifier
+	for id, obj := range info.Defs {
+		if obj == old {
+			id.Name = new
+		}
+	}
+	// The fields which embed the type, found from their
+	// declarations so it works for aliases too, eg "type A = int"
+	embedded := map[*types.Var]bool{}
+	for id, obj := range info.Uses {
+		if obj == old {
+			if field, ok := info.Defs[id].(*types.Var); ok && field.Anonymous() {
+				embedded[field] = true
+			}
+		}
+	}
+	for id, obj := range info.Uses {
+		if obj == old {
+			id.Name = new
+		} else {
+			if var_, ok := obj.(*types.Var); ok && var_.Anonymous() && embedded[var_] {
+				// This is an anonymous field in composite literal
+				// or a selector.  We should replace it with the
+				// field name of the type it represents if we
+				// replace that type, eg Pair for *Pair[int, string]
+				id.Name = embeddedFieldName(new)
+			}
+		}
+	}
+	// Conversions to types starting with * or <- or func need
+	// brackets, eg (*T)(x) not *T(x)
+	if needsParens(new) {
+		for expr := range info.Types {
+			if call, ok := expr.(*ast.CallExpr); ok {
+				if id, ok := call.Fun.(*ast.Ident); ok && info.Uses[id] == old {
+					id.Name = "(" + new + ")"
+				}
+			}
+		}
+	}
+}
+
+// typeExpr parses the type typ, returning nil if it doesn't parse
+func typeExpr(typ string) ast.Expr {
+	expr, err := parser.ParseExpr(typ)
+	if err != nil {
+		return nil
+	}
+	return expr
+}
+
+// embeddedFieldName returns the name of the field the type typ makes
+// when it is embedded in a struct, eg Pair for *pkg.Pair[int, string]
+func embeddedFieldName(typ string) string {
+	expr := typeExpr(typ)
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.SelectorExpr:
+			return e.Sel.Name
+		case *ast.Ident:
+			return e.Name
+		default:
+			return typ
+		}
+	}
+}
+
+// needsParens returns whether the type typ needs brackets round it
+// when it is converted to
+func needsParens(typ string) bool {
+	switch e := typeExpr(typ).(type) {
+	case *ast.StarExpr, *ast.ChanType, *ast.FuncType:
+		return true
+	case *ast.UnaryExpr:
+		return e.Op == token.ARROW
+	}
+	return false
+}
+
+// isInstantiation returns whether the type typ is an instantiated
+// generic type, eg Pair[int, string]
+func isInstantiation(typ string) bool {
+	expr := typeExpr(typ)
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr, *ast.IndexListExpr:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// checkReceivers makes sure there aren't any methods on a template
+// parameter whose argument is an instantiated generic type, as Go
+// would read the type arguments in the receiver as type parameters
+func (t *template) checkReceivers(f *ast.File, info *types.Info) {
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Recv == nil || len(d.Recv.List) == 0 {
+			continue
+		}
+		recv := d.Recv.List[0].Type
+		for {
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			} else if paren, ok := recv.(*ast.ParenExpr); ok {
+				recv = paren.X
+			} else {
+				break
+			}
+		}
+		id, ok := recv.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if to, ok := t.mappings[info.Uses[id]]; ok && isInstantiation(to) {
+			fatalf("Can't make method %s on %s as it is an instantiated generic type", d.Name.Name, to)
+		}
+	}
+}
+
+// Parses the template file
+func (t *template) parse(inputFile string) []byte {
+	t.inputFile = inputFile
+
+	src, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		fatalf("Failed to read template: %v", err)
+	}
+	_, f := parseFile(inputFile, src)
+	t.findTemplateDefinition(f)
+	t.typeCheckArgs(f)
+
+	// Only type check the branches of the conditionals taken
+	conf := &packages.Config{}
+	t.pruneConditionals(conf, inputFile, src)
+	if t.withTests {
+		dir := filepath.Dir(inputFile)
+		if p, err := build.ImportDir(dir, 0); err == nil {
+			for _, name := range p.TestGoFiles {
+				fileName := filepath.Join(dir, name)
+				if src, err := ioutil.ReadFile(fileName); err == nil {
+					t.pruneConditionals(conf, fileName, src)
+				}
+			}
+		}
+	}
+
+	var pkg *packages.Package
+	if t.withTests {
+		_, pkg = loadTemplateTests(conf, inputFile)
+	} else {
+		pkgs, err := loadPackages(conf, inputFile)
+		if err != nil {
+			fatalf("Type checking error: %v", err)
+		}
+		pkg = pkgs[0]
+	}
+
+	// These can't be caused by the arguments as they aren't
+	// substituted yet
+	if problems := packageDiagnostics([]*packages.Package{pkg}); len(problems) > 0 {
+		fatalf("Type checking error: found %d errors in template %q itself\n%v", len(problems), t.Package, problems)
+	}
+
+	info := pkg.TypesInfo
+	fset := pkg.Fset
+	f = pkg.Syntax[0]
+	if t.withTests {
+		t.testFset, t.testSyntax = fset, nil
+		for i, fileName := range pkg.CompiledGoFiles {
+			if fileName == inputFile {
+				f = pkg.Syntax[i]
+			} else {
+				t.testSyntax = append(t.testSyntax, pkg.Syntax[i])
+			}
+		}
+	}
+
+	positions := declPositions(fset, f)
+
+	t.removeConditionals(f)
+	for _, testFile := range t.testSyntax {
+		t.removeConditionals(testFile)
+	}
+	if len(t.argErrors) > 0 {
+		fatalf("Found %d errors in the arguments of %s\n%v", len(t.argErrors), t.spec(), t.argErrors)
+	}
+	if t.specialized {
+		removeBuildConstraints(f)
+	}
+	t.replacePkgParams(f, info)
+	directives, directiveComments := findDeclDirectives(f)
+	for id, d := range directives {
+		t.declDirectives[info.Defs[id]] = d
+	}
+
+	// debugf("Decls = %#v", f.Decls)
+	// Find names which need to be adjusted
+	namesToMangle := map[types.Object]string{}
+	newDecls := []ast.Decl{}
+	for _, decl := range f.Decls {
+		remove := false
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			// A general definition
+			switch d.Tok {
+			case token.IMPORT:
+				// Ignore imports
+			case token.CONST, token.VAR:
+				// Find and remove identifiers found in template
+				// params
+				emptySpecs := []int{}
+				for i, spec := range d.Specs {
+					namesToRemove := []int{}
+					v := spec.(*ast.ValueSpec)
+					for j, name := range v.Names {
+						debugf("VAR or CONST %v", name.Name)
+						def := info.Defs[name]
+						if t.removeParam(name.Name, def) {
+							namesToRemove = append(namesToRemove, j)
+						} else {
+							namesToMangle[def] = name.Name
+						}
+					}
+					// Shuffle the names to remove out of v.Names and v.Values
+					for i := len(namesToRemove) - 1; i >= 0; i-- {
+						p := namesToRemove[i]
+						v.Names = append(v.Names[:p], v.Names[p+1:]...)
+						v.Values = append(v.Values[:p], v.Values[p+1:]...)
+					}
+					// If empty then add to slice to remove later
+					if len(v.Names) == 0 {
+						emptySpecs = append(emptySpecs, i)
+					}
+				}
+				// Remove now-empty specs
+				for i := len(emptySpecs) - 1; i >= 0; i-- {
+					p := emptySpecs[i]
+					d.Specs = append(d.Specs[:p], d.Specs[p+1:]...)
+				}
+				remove = len(d.Specs) == 0
+			case token.TYPE:
+				namesToRemove := []int{}
+				for i, spec := range d.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+					debugf("Type %v", typeSpec.Name.Name)
+					// Remove type A if it is a template definition
+					def := info.Defs[typeSpec.Name]
+					if t.removeParam(typeSpec.Name.Name, def) {
+						namesToRemove = append(namesToRemove, i)
+					} else {
+						namesToMangle[def] = typeSpec.Name.Name
+					}
+				}
+				for i := len(namesToRemove) - 1; i >= 0; i-- {
+					p := namesToRemove[i]
+					d.Specs = append(d.Specs[:p], d.Specs[p+1:]...)
+				}
+				remove = len(d.Specs) == 0
+			default:
+				logf("Unknown type %s", d.Tok)
+			}
+			debugf("GenDecl = %#v", d)
+		case *ast.FuncDecl:
+			// A function definition
+			if d.Recv != nil {
+				// Has receiver so is a method - ignore this function
+			} else if d.Name.Name == "init" {
+				// Init function - ignore this function
+			} else {
+				//debugf("FuncDecl = %#v", d)
+				debugf("FuncDecl = %s", d.Name.Name)
+				def := info.Defs[d.Name]
+				// Remove func A() if it is a template definition
+				if t.removeParam(d.Name.Name, def) {
+					remove = true
+				} else {
+					namesToMangle[def] = d.Name.Name
+				}
+			}
+		default:
+			fatalf("Unknown Decl %#v", decl)
+		}
+		if !remove {
+			newDecls = append(newDecls, decl)
+		}
+	}
+	debugf("Names to mangle = %#v", namesToMangle)
+
+	// Remove the stub type definitions "type A int" from the package
+	f.Decls = newDecls
+
+	found := false
+	for obj, name := range namesToMangle {
+		if name == t.templateName {
+			found = true
+			t.addMapping(obj, name)
+		} else if _, found := t.mappings[obj]; !found {
+			t.addMapping(obj, name)
+		}
+
+	}
+	if !found {
+		fatalf("No definition for template type '%s'", t.templateName)
+	}
+
+	// Move the helpers which don't depend on the template
+	// parameters out of the instance
+	var sharedDecls []*ast.FuncDecl
+	ownNames := map[*ast.FuncDecl]string{} // names of the helpers if they aren't shared
+	if t.shareHelpers {
+		helpers := t.findSharedHelpers(f, info, pkg.Types)
+		for _, decl := range f.Decls {
+			if d, ok := decl.(*ast.FuncDecl); ok && helpers[info.Defs[d.Name]] != nil {
+				ownNames[d] = t.mappings[info.Defs[d.Name]]
+				t.mappings[info.Defs[d.Name]] = sharedName(d.Name.Name, t.templateName)
+				sharedDecls = append(sharedDecls, d)
+			}
+		}
+	}
+	if t.withTests {
+		t.mangleTestDecls(info)
+	}
+	declared := map[string]bool{}
+	for _, name := range namesToMangle {
+		declared[name] = true
+	}
+	for _, testFile := range t.testSyntax {
+		for _, id := range topLevelIdents(testFile) {
+			declared[id.Name] = true
+		}
+	}
+	t.naming.checkRenames(declared)
+	t.renameTypeParams(f, info)
+	debugf("mappings = %#v", t.mappings)
+	t.checkReceivers(f, info)
+
+	// Replace the identifiers
+	for id, replacement := range t.mappings {
+		replaceIdentifier(f, info, id, replacement)
+	}
+
+	t.addArgImports(fset, f)
+	for _, testFile := range t.testSyntax {
+		t.addArgImports(t.testFset, testFile)
+	}
+
+	t.markRepeats(fset, f, info)
+
+	// Change the package to the local package name
+	f.Name.Name = t.NewPackage
+
+	outputFileName := t.outputFileName()
+
+	// The shared file is written along with the instance
+	var sharedFile string
+	var sharedSrc []byte
+	var sharedHelpers map[string]*sharedHelper
+	if t.shareHelpers {
+		var unlock func()
+		sharedFile, sharedHelpers, unlock = t.readShared(outputFileName)
+		defer unlock()
+		sharedDecls = t.unshareDifferent(fset, f, info, sharedDecls, sharedHelpers, ownNames)
+		isShared := map[ast.Decl]bool{}
+		for _, d := range sharedDecls {
+			isShared[d] = true
+		}
+		newDecls = nil
+		for _, decl := range f.Decls {
+			if !isShared[decl] {
+				newDecls = append(newDecls, decl)
+			}
+		}
+		f.Decls = newDecls
+	}
+
+	t.checkCollisions(fset, f, info, sharedDecls)
+
+	if t.shareHelpers {
+		if !t.dryRun {
+			sharedSrc = t.mergeShared(fset, f, sharedDecls, sharedHelpers, sharedFile, outputFileName)
+		}
+		for _, d := range sharedDecls {
+			from := d.Pos()
+			if d.Doc != nil {
+				from = d.Doc.Pos()
+			}
+			removeComments(f, from, d.End())
+		}
+	}
+
+	removeDirectiveComments(fset, f, directiveComments)
+
+	// Output but only if contents have changed from existing file
+
+	b := new(bytes.Buffer)
+
+	format := func() {
+		b.Reset()
+		if err := format.Node(b, fset, f); err != nil {
+			fatalf("Failed to format output: %v", err)
+		}
+		bts, err := imports.Process(filepath.Join(t.Dir, outputFileName), b.Bytes(), nil)
+		if err != nil {
+			fatalf("Cannot fix imports: %v", err)
+		}
+		b.Reset()
+		if _, err := b.Write(bts); err != nil {
+			fatalf("Cannot write output: %v", err)
+		}
+	}
+
+	t.declPositions = nil
+	for _, decl := range instanceDecls(f) {
+		t.declPositions = append(t.declPositions, positions[decl])
+	}
+
+	format()
+
+	if t.variadic {
+		t.declPositions = t.expandDeclPositions(outputFileName, b.Bytes(), t.declPositions)
+		b = bytes.NewBuffer(t.expandRepeats(outputFileName, b.Bytes()))
+	}
+
+	// bit gross to inject the header this way... but in the spirit of
+	// minimal changes et al...
+	fset, f = parseFile(outputFileName, genHeader+b.String())
+
+	format()
+
+	if t.lineDirectives {
+		b = bytes.NewBuffer(t.addLineDirectives(outputFileName, b.Bytes()))
+	}
+
+	if t.bundle {
+		if !t.dryRun {
+			t.writeBundle(filepath.Join(t.Dir, outputFileName), b.Bytes())
+		}
+	} else if !t.dryRun {
+		if t.typeCheck {
+			if sharedSrc != nil {
+				if t.overlay == nil {
+					t.overlay = map[string][]byte{}
+				}
+				t.overlay[sharedFile] = sharedSrc
+			}
+			t.checkTypes(b.Bytes())
+		}
+		if sharedFile != "" {
+			writeShared(sharedFile, sharedSrc)
+		}
+		writeFile(filepath.Join(t.Dir, outputFileName), b.Bytes())
+	}
+	if !t.dryRun {
+		if t.withTests {
+			t.writeTestFiles()
+		}
+	}
+	return b.Bytes()
+}
+
+// spec returns the instance spec, eg "MySet(int)"
+func (t *template) spec() string {
+	return t.Name + "(" + strings.Join(t.Args, ", ") + ")"
+}
+
+// outputFileName returns the name of the file in t.Dir the instance
+// is written to
+func (t *template) outputFileName() string {
+	if t.outputFile != "" {
+		return t.outputFile
+	}
+	name := t.Name
+	if t.bundle {
+		name = t.bundleName
+	}
+	if t.testOutput {
+		return fmt.Sprintf(t.outputFormat+"_test.go", name)
+	}
+	return fmt.Sprintf(t.outputFormat+".go", name)
+}
+
+// generatedFrom sets up the instance for a go:generate directive in
+// fileName in the package pkgName, as go generate passes in $GOFILE
+// and $GOPACKAGE
+//
+// Directives in test files make instances in test files in the same
+// package, which may be an external test package.  If pkgName isn't
+// known it is read from fileName.  Outside go generate, fileName is
+// empty and -test writes to the package the tests in t.Dir are in.
+//
+// With -bundle the instances from the directives in the same file are
+// written to one file named after it.
+func (t *template) generatedFrom(fileName, pkgName string) {
+	if fileName != "" && !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(t.Dir, fileName)
+	}
+	if t.bundle && fileName != "" {
+		t.bundleFrom = fileName
+		t.bundleName = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(fileName), ".go"), "_test")
+	}
+	if !strings.HasSuffix(fileName, "_test.go") {
+		if fileName == "" && t.testOutput {
+			t.NewPackage = findTestPackageName(t.Dir)
+		}
+		return
+	}
+	t.testOutput = true
+	if pkgName == "" {
+		pkgName = filePackageName(fileName)
+	}
+	t.NewPackage = pkgName
+}
+
+// writeFile writes b to fileName but only if the contents have
+// changed from the existing file
+func writeFile(fileName string, b []byte) {
+	write := true
+
+	var curr []byte
+	if !testingMode {
+		var err error
+		curr, err = ioutil.ReadFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			fatalf("Cannot open existing file: %v", err)
+		}
+	}
+
+	if bytes.Equal(curr, b) {
+		write = false
+		emit(event{Action: actionUnchanged, File: fileName})
+	}
+
+	if write {
+		if err := replaceFile(fileName, b); err != nil {
+			fatalf("Unable to write to %q: %v", fileName, err)
+		}
+		emit(event{Action: actionWrite, File: fileName})
+	}
+
+	debugf("Written '%s'", fileName)
+}
+
+// replaceFile writes b to a temporary file next to fileName then
+// renames it so instances generated in parallel never read a partly
+// written file
+//
+// The temporary file starts with "." so the go tools ignore it.  An
+// existing file keeps its permissions.
+func replaceFile(fileName string, b []byte) error {
+	tmpName := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	err := ioutil.WriteFile(tmpName, b, 0666)
+	if err == nil {
+		if fi, statErr := os.Stat(fileName); statErr == nil {
+			err = os.Chmod(tmpName, fi.Mode().Perm())
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+// importTemplate finds the template package pkg from dir returning
+// it and the path of the file with the template in
+func importTemplate(pkg, dir string) (*build.Package, string) {
+	p, err := build.Default.Import(pkg, dir, build.ImportMode(0))
+	if err != nil {
+		fatalf("Import %s failed: %s", pkg, err)
+	}
+	//debugf("package = %#v", p)
+	debugf("Dir = %#v", p.Dir)
+	// FIXME CgoFiles ?
+	debugf("Go files = %#v", p.GoFiles)
+
+	if len(p.GoFiles) == 0 {
+		fatalf("No go files found for package '%s'", pkg)
+	}
+	// FIXME
+	if len(p.GoFiles) != 1 {
+		fatalf("Found more than one go file in '%s' - can only cope with 1 for the moment, sorry", pkg)
+	}
+	return p, path.Join(p.Dir, p.GoFiles[0])
+}
+
+// findTemplateFile finds the template package and the file in it
+// to instantiate, which may be a specialization
+func (t *template) findTemplateFile() (*build.Package, string) {
+	p, templateFilePath := importTemplate(t.Package, t.Dir)
+	t.templatePath = p.ImportPath
+	if build.IsLocalImport(p.ImportPath) || strings.HasPrefix(p.ImportPath, "_") {
+		// Outside GOPATH so use the path it was given by
+		t.templatePath = t.Package
+	}
+	if specialization := t.findSpecialization(p); specialization != "" {
+		debugf("Using specialization %q", specialization)
+		templateFilePath = specialization
+		t.specialized = true
+	}
+	return p, templateFilePath
+}
+
+// Instantiate the template package
+func (t *template) instantiate() {
+	debugf("Substituting %q with %s(%s) into package %s", t.Package, t.Name, strings.Join(t.Args, ","), t.NewPackage)
+
+	emit(event{Action: actionStart, Template: t.Package, Instance: t.spec(), File: filepath.Join(t.Dir, t.outputFileName())})
+	p, templateFilePath := t.findTemplateFile()
+	if t.shareHelpers && t.testOutput {
+		// The shared file isn't a test file and may be in a
+		// different package
+		debugf("Not sharing the helpers of %s as it is in a test file", t.spec())
+		t.shareHelpers = false
+	}
+	if t.bundle {
+		if t.bundleName == "" {
+			fatalf("Bundles need $GOFILE set by go generate or a config file")
+		}
+		if t.lineDirectives {
+			fatalf("Can't use -line-directives with bundles")
+		}
+		// The shared helpers record which files use them
+		t.shareHelpers = false
+	}
+	if t.lockFile != "" {
+		t.checkLock(p)
+	}
+
+	// The shared helpers file and bundles can't be reproduced from
+	// the cache and the cached instance may not type check with the
+	// rest of the package as it is now
+	var key string
+	if t.cache && !t.shareHelpers && !t.bundle {
+		key = t.cacheKey(p)
+		if b, ok := readCache(key); ok {
+			if t.typeCheck && len(t.typeCheckInstance(b)) > 0 {
+				// Instantiate it again to report the errors
+				debugf("Cached instance %s doesn't type check", key)
+			} else {
+				debugf("Using cached instance %s", key)
+				t.checkCachedCollisions(b)
+				writeFile(filepath.Join(t.Dir, t.outputFileName()), b)
+				return
+			}
+		}
+	}
+	b := t.parse(templateFilePath)
+	if key != "" && !t.usesDestination {
+		writeCache(key, b)
+	}
+}
+
+// instanceSource instantiates the template without writing any
+// files, returning the source of the instance
+func (t *template) instanceSource() []byte {
+	t.dryRun = true
+	_, templateFilePath := t.findTemplateFile()
+	return t.parse(templateFilePath)
+}
@@ -0,0 +1,3520 @@
+// Tests for template
+
+package gotemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/cover"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/packages"
+)
+
+func init() {
+	testingMode = true
+}
+
+type TestTemplate struct {
+	title   string
+	args    string
+	pkg     string
+	in      string
+	outName string
+	out     string
+	files   map[string]string // extra files to write relative to GOPATH/src
+	naming  *namingPolicy     // naming policy if not the default
+	lines   bool              // add line directives
+}
+
+const basicTest = `package tt
+
+// template type Set(A)
+type A int
+
+func init() {}
+
+type Set struct { a A }
+func NewSet(a A) A { return A(0) }
+func NewSizedSet(a A) A { return A(1) }
+func UtilityFunc1() {}
+func utilityFunc() {}
+func (a A) f0() {}
+func (a *A) F1() {}
+
+type N struct{}
+type M struct{ N }
+type K struct{ N int }
+
+func (a *A) N() {}
+func (a *A) O() { a.N() }
+func f2() M     { return M{N: N{}} }
+func f3() K     { return K{N: 0} }
+func f4() N     { return f2().N }
+func f5() int   { return f3().N }
+func f6() {
+	N := 0
+	_ = N
+}
+
+var AVar1 int
+var aVar2 int
+var (
+	AVar3 int
+	aVar4 int
+)
+`
+
+const conditionalTest = `package tt
+
+// template type Set(A)
+type A int
+
+type Set map[A]struct{}
+
+// template if ordered(A)
+
+// Sorted returns the elements in order
+func (s Set) Sorted() []A { return nil }
+
+// template else
+
+// Unsorted returns the elements in any order
+func (s Set) Unsorted() []A { return nil }
+
+// template end
+
+// template if integer(A)
+// Bits returns the set as a bitset
+func (s Set) Bits() uint64 { return 0 }
+// template end
+
+const (
+	a = 1
+	// template if !comparable(A) || string(A)
+	slow = true
+	// template end
+)
+`
+
+const conditionalSameNameTest = `package tt
+
+import "fmt"
+
+// template type Sorter(A)
+type A int
+
+type Sorter []A
+
+// template if ordered(A)
+
+// less compares a and b
+func less(a, b A) bool { return a < b }
+
+// template else
+
+// less compares a and b
+func less(a, b A) bool { return fmt.Sprint(a) < fmt.Sprint(b) }
+
+// template end
+
+func (s Sorter) Less(i, j int) bool { return less(s[i], s[j]) }
+`
+
+const specializeTest = `package tt
+
+// template type Pair(A, B)
+type A int
+type B int
+
+type Pair struct {
+	a A
+	b B
+}
+`
+
+var specializeFiles = map[string]string{
+	"input/pair_bool.go": `//go:build ignore
+
+package tt
+
+// template type Pair(A, B)
+// template specialize Pair(bool, _)
+type A bool
+type B int
+
+type Pair struct {
+	b    B
+	a, x A
+}
+`,
+	"input/pair_bool_string.go": `//go:build ignore
+
+package tt
+
+// template type Pair(A, B)
+// template specialize Pair(bool, string)
+type A bool
+type B string
+
+type Pair struct {
+	b B
+	a A
+}
+`,
+}
+
+const pkgParamTest = `package tt
+
+import (
+	"clock"
+	"fmt"
+)
+
+// template type Timer(A, pkg clock)
+type A int
+
+type Timer struct{ a A }
+
+func (t Timer) String() string { return fmt.Sprint(t.a, clock.Now()) }
+`
+
+var pkgParamFiles = map[string]string{
+	"clock/clock.go":     "package clock\n\nfunc Now() int { return 0 }\n",
+	"fakeclock/clock.go": "package fakeclock\n\nfunc Now() int { return 1 }\n",
+	"fake/v2/clock.go":   "package fake\n\nfunc Now() int { return 2 }\n",
+}
+
+const argImportTest = `package tt
+
+import "model"
+
+// template type Store(A)
+type A int
+
+type Store struct {
+	items   []A
+	version model.Version
+}
+
+// template if comparable(A)
+func (s *Store) Has(a A) bool {
+	for _, item := range s.items {
+		if item == a {
+			return true
+		}
+	}
+	return false
+}
+
+// template end
+`
+
+var argImportFiles = map[string]string{
+	"model/model.go":           "package model\n\ntype Version int\n\ntype User struct{ Name string }\n",
+	"app/model/model.go":       "package model\n\ntype User struct{ ID int }\n",
+	"gopkg.in/yaml.v2/yaml.go": "package yaml\n\ntype Node struct{ Value string }\n",
+}
+
+const namingTest = `package tt
+
+// template type Set(A)
+type A int
+
+type Set struct{ a A }
+
+func NewSet() *Set { return &Set{} }
+
+func utilityFunc() {}
+
+func Exported() {}
+
+var count int
+
+const Max = 1
+`
+
+const variadicDeclTest = `package tt
+
+// template type Checks(A...)
+type A int
+
+type Checks struct {
+	// template repeat
+	isA bool
+}
+
+// template repeat
+func IsA(x interface{}) bool { _, ok := x.(A); return ok }
+
+func Count() int { return 0 }
+`
+
+const directiveTest = `package tt
+
+import "errors"
+
+// template type Set(A)
+type A int
+
+// Set is a set of A
+//
+// gotemplate:name {{Name}}Type
+type Set struct{ a A }
+
+// ErrNotFound is returned when an element is missing
+//
+// gotemplate:keep
+var ErrNotFound = errors.New("not found")
+
+// gotemplate:private
+func Helper() {}
+
+// gotemplate:name New{{Name}}
+// gotemplate:private
+func Make() *Set { return &Set{} }
+
+// gotemplate:keep
+const (
+	limit = 10
+	// gotemplate:private
+	Other = 1
+)
+`
+
+var tests = []TestTemplate{
+	{
+		title:   "Simple test public",
+		args:    "MySet(int)",
+		pkg:     "main",
+		in:      basicTest,
+		outName: "gotemplate_MySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+func init() {}
+
+type MySet struct{ a int }
+
+func NewMySet(a int) int      { return int(0) }
+func NewSizedMySet(a int) int { return int(1) }
+func UtilityFunc1MySet()      {}
+func utilityFuncMySet()       {}
+func (a int) f0()             {}
+func (a *int) F1()            {}
+
+type NMySet struct{}
+type MMySet struct{ NMySet }
+type KMySet struct{ N int }
+
+func (a *int) N()     {}
+func (a *int) O()     { a.N() }
+func f2MySet() MMySet { return MMySet{NMySet: NMySet{}} }
+func f3MySet() KMySet { return KMySet{N: 0} }
+func f4MySet() NMySet { return f2MySet().NMySet }
+func f5MySet() int    { return f3MySet().N }
+func f6MySet() {
+	N := 0
+	_ = N
+}
+
+var AVar1MySet int
+var aVar2MySet int
+var (
+	AVar3MySet int
+	aVar4MySet int
+)
+`,
+	},
+	{
+		title:   "Simple test private",
+		args:    "mySet(float64)",
+		pkg:     "main",
+		in:      basicTest,
+		outName: "gotemplate_mySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+func init() {}
+
+type mySet struct{ a float64 }
+
+func newMySet(a float64) float64      { return float64(0) }
+func newSizedMySet(a float64) float64 { return float64(1) }
+func utilityFunc1MySet()              {}
+func utilityFuncMySet()               {}
+func (a float64) f0()                 {}
+func (a *float64) F1()                {}
+
+type nMySet struct{}
+type mMySet struct{ nMySet }
+type kMySet struct{ N int }
+
+func (a *float64) N() {}
+func (a *float64) O() { a.N() }
+func f2MySet() mMySet { return mMySet{nMySet: nMySet{}} }
+func f3MySet() kMySet { return kMySet{N: 0} }
+func f4MySet() nMySet { return f2MySet().nMySet }
+func f5MySet() int    { return f3MySet().N }
+func f6MySet() {
+	N := 0
+	_ = N
+}
+
+var aVar1MySet int
+var aVar2MySet int
+var (
+	aVar3MySet int
+	aVar4MySet int
+)
+`,
+	},
+	{
+		title:   "Conditional ordered",
+		args:    "IntSet(int)",
+		pkg:     "main",
+		in:      conditionalTest,
+		outName: "gotemplate_IntSet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type IntSet map[int]struct{}
+
+// Sorted returns the elements in order
+func (s IntSet) Sorted() []int { return nil }
+
+// Bits returns the set as a bitset
+func (s IntSet) Bits() uint64 { return 0 }
+
+const (
+	aIntSet = 1
+)
+`,
+	},
+	{
+		title:   "Conditional not comparable",
+		args:    "BytesSet([]byte)",
+		pkg:     "main",
+		in:      conditionalTest,
+		outName: "gotemplate_BytesSet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type BytesSet map[[]byte]struct{}
+
+// Unsorted returns the elements in any order
+func (s BytesSet) Unsorted() [][]byte { return nil }
+
+const (
+	aBytesSet = 1
+
+	slowBytesSet = true
+)
+`,
+	},
+	{
+		title:   "Conditional branches declaring the same name",
+		args:    "BytesSorter([]byte)",
+		pkg:     "main",
+		in:      conditionalSameNameTest,
+		outName: "gotemplate_BytesSorter.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import "fmt"
+
+// template type Sorter(A)
+
+type BytesSorter [][]byte
+
+// less compares a and b
+func lessBytesSorter(a, b []byte) bool { return fmt.Sprint(a) < fmt.Sprint(b) }
+
+func (s BytesSorter) Less(i, j int) bool { return lessBytesSorter(s[i], s[j]) }
+`,
+	},
+	{
+		title:   "Specialization not used",
+		args:    "IntPair(int, int)",
+		pkg:     "main",
+		in:      specializeTest,
+		files:   specializeFiles,
+		outName: "gotemplate_IntPair.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Pair(A, B)
+
+type IntPair struct {
+	a int
+	b int
+}
+`,
+	},
+	{
+		title:   "Specialization with wildcard",
+		args:    "BoolPair(bool, int)",
+		pkg:     "main",
+		in:      specializeTest,
+		files:   specializeFiles,
+		outName: "gotemplate_BoolPair.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Pair(A, B)
+// template specialize Pair(bool, _)
+
+type BoolPair struct {
+	b    int
+	a, x bool
+}
+`,
+	},
+	{
+		title:   "Specialization most specific",
+		args:    "BoolStringPair(bool, string)",
+		pkg:     "main",
+		in:      specializeTest,
+		files:   specializeFiles,
+		outName: "gotemplate_BoolStringPair.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Pair(A, B)
+// template specialize Pair(bool, string)
+
+type BoolStringPair struct {
+	b string
+	a bool
+}
+`,
+	},
+	{
+		title: "Variadic",
+		args:  "Triple(int, string, []byte)",
+		pkg:   "main",
+		in: `package tt
+
+import "fmt"
+
+// template type Tuple(A...)
+type A int
+
+type Tuple struct {
+	// template repeat
+	F A
+}
+
+func NewTuple(
+	// template repeat
+	f A,
+) Tuple {
+	return Tuple{
+		// template repeat
+		F: f,
+	}
+}
+
+func (t Tuple) String() string {
+	s := ""
+	// template repeat
+	s += fmt.Sprint(t.F)
+	return s
+}
+
+func Kind(x interface{}) string {
+	switch x.(type) {
+	// template repeat
+	case A:
+		return fmt.Sprintf("%T", x)
+	}
+	return ""
+}
+`,
+		outName: "gotemplate_Triple.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import "fmt"
+
+// template type Tuple(A...)
+
+type Triple struct {
+	F0 int
+	F1 string
+	F2 []byte
+}
+
+func NewTriple(
+	f0 int,
+	f1 string,
+	f2 []byte,
+) Triple {
+	return Triple{
+		F0: f0,
+		F1: f1,
+		F2: f2,
+	}
+}
+
+func (t Triple) String() string {
+	s := ""
+	s += fmt.Sprint(t.F0)
+	s += fmt.Sprint(t.F1)
+	s += fmt.Sprint(t.F2)
+	return s
+}
+
+func KindTriple(x interface{}) string {
+	switch x.(type) {
+	case int:
+		return fmt.Sprintf("%T", x)
+	case string:
+		return fmt.Sprintf("%T", x)
+	case []byte:
+		return fmt.Sprintf("%T", x)
+	}
+	return ""
+}
+`,
+	},
+	{
+		title: "Variadic names from types",
+		args:  "Kinds(int, []byte, error)",
+		pkg:   "main",
+		in: `package tt
+
+// template type Checks(A...)
+type A int
+
+type Checks struct {
+	// template repeat
+	isA bool
+}
+
+// template repeat
+func IsA(x interface{}) bool { _, ok := x.(A); return ok }
+`,
+		outName: "gotemplate_Kinds.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Checks(A...)
+
+type Kinds struct {
+	isInt   bool
+	isA1    bool
+	isError bool
+}
+
+func IsIntKinds(x interface{}) bool   { _, ok := x.(int); return ok }
+func IsA1Kinds(x interface{}) bool    { _, ok := x.([]byte); return ok }
+func IsErrorKinds(x interface{}) bool { _, ok := x.(error); return ok }
+`,
+	},
+	{
+		title: "Variadic named",
+		args:  "Color(Red, Green, Blue)",
+		pkg:   "main",
+		in: `package tt
+
+// template type Enum(Value...)
+const Value = 0
+
+type Enum int
+
+const (
+	// template repeat
+	EnumValue Enum = iota
+)
+
+var EnumNames = []string{
+	// template repeat
+	"?",
+}
+`,
+		outName: "gotemplate_Color.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Enum(Value...)
+
+type Color int
+
+const (
+	ColorRed   Color = iota
+	ColorGreen Color = iota
+	ColorBlue  Color = iota
+)
+
+var ColorNames = []string{
+	"?",
+	"?",
+	"?",
+}
+`,
+	},
+	{
+		title:   "Package parameter",
+		args:    `FakeTimer(int, "fakeclock")`,
+		pkg:     "main",
+		in:      pkgParamTest,
+		files:   pkgParamFiles,
+		outName: "gotemplate_FakeTimer.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	"fakeclock"
+	"fmt"
+)
+
+// template type Timer(A, pkg clock)
+
+type FakeTimer struct{ a int }
+
+func (t FakeTimer) String() string { return fmt.Sprint(t.a, fakeclock.Now()) }
+`,
+	},
+	{
+		title:   "Package parameter with different name",
+		args:    `V2Timer(int, "fake/v2")`,
+		pkg:     "main",
+		in:      pkgParamTest,
+		files:   pkgParamFiles,
+		outName: "gotemplate_V2Timer.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	fake "fake/v2"
+	"fmt"
+)
+
+// template type Timer(A, pkg clock)
+
+type V2Timer struct{ a int }
+
+func (t V2Timer) String() string { return fmt.Sprint(t.a, fake.Now()) }
+`,
+	},
+	{
+		title:   "Argument with import path",
+		args:    `UserStore("app/model".User)`,
+		pkg:     "main",
+		in:      argImportTest,
+		files:   argImportFiles,
+		outName: "gotemplate_UserStore.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	model2 "app/model"
+	"model"
+)
+
+// template type Store(A)
+
+type UserStore struct {
+	items   []model2.User
+	version model.Version
+}
+
+func (s *UserStore) Has(a model2.User) bool {
+	for _, item := range s.items {
+		if item == a {
+			return true
+		}
+	}
+	return false
+}
+`,
+	},
+	{
+		title:   "Arguments with import paths in composite types",
+		args:    `NodeStore(map["app/model".User][]*"gopkg.in/yaml.v2".Node)`,
+		pkg:     "main",
+		in:      argImportTest,
+		files:   argImportFiles,
+		outName: "gotemplate_NodeStore.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	model2 "app/model"
+	"model"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// template type Store(A)
+
+type NodeStore struct {
+	items   []map[model2.User][]*yaml.Node
+	version model.Version
+}
+`,
+	},
+	{
+		title:   "Naming prefix",
+		args:    "mySet(int)",
+		pkg:     "main",
+		in:      namingTest,
+		naming:  &namingPolicy{prefix: true, export: exportAuto},
+		outName: "gotemplate_mySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type mySet struct{ a int }
+
+func newMySet() *mySet { return &mySet{} }
+
+func mySetUtilityFunc() {}
+
+func mySetExported() {}
+
+var mySetCount int
+
+const mySetMax = 1
+`,
+	},
+	{
+		title:   "Naming prefix exported",
+		args:    "MySet(int)",
+		pkg:     "main",
+		in:      namingTest,
+		naming:  &namingPolicy{prefix: true, export: exportAuto},
+		outName: "gotemplate_MySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type MySet struct{ a int }
+
+func NewMySet() *MySet { return &MySet{} }
+
+func mySetUtilityFunc() {}
+
+func MySetExported() {}
+
+var mySetCount int
+
+const MySetMax = 1
+`,
+	},
+	{
+		title:   "Naming public",
+		args:    "mySet(int)",
+		pkg:     "main",
+		in:      namingTest,
+		naming:  &namingPolicy{export: exportPublic},
+		outName: "gotemplate_mySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type MySet struct{ a int }
+
+func NewMySet() *MySet { return &MySet{} }
+
+func utilityFuncMySet() {}
+
+func ExportedMySet() {}
+
+var countMySet int
+
+const MaxMySet = 1
+`,
+	},
+	{
+		title:   "Naming private with rename",
+		args:    "MySet(int)",
+		pkg:     "main",
+		in:      namingTest,
+		naming:  &namingPolicy{export: exportPrivate, renames: map[string]string{"NewSet": "MakeSet"}},
+		outName: "gotemplate_MySet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type mySet struct{ a int }
+
+func MakeSet() *mySet { return &mySet{} }
+
+func utilityFuncMySet() {}
+
+func exportedMySet() {}
+
+var countMySet int
+
+const maxMySet = 1
+`,
+	},
+	{
+		title:   "Line directives",
+		args:    "MySet(int)",
+		pkg:     "main",
+		in:      directiveTest,
+		outName: "gotemplate_MySet.go",
+		lines:   true,
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import "errors"
+
+// template type Set(A)
+
+// Set is a set of A
+//line ../input/main.go:11
+type MySetType struct{ a int }
+
+// ErrNotFound is returned when an element is missing
+//line ../input/main.go:16
+var ErrNotFound = errors.New("not found")
+
+//line ../input/main.go:19
+func helperMySet() {}
+
+//line ../input/main.go:23
+func newMySet() *MySetType { return &MySetType{} }
+
+//line ../input/main.go:26
+const (
+	limit = 10
+	other = 1
+)
+`,
+	},
+	{
+		title:   "Variadic line directives",
+		args:    "Kinds(int, string)",
+		pkg:     "main",
+		in:      variadicDeclTest,
+		outName: "gotemplate_Kinds.go",
+		lines:   true,
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Checks(A...)
+
+//line ../input/main.go:6
+type Kinds struct {
+	isInt    bool
+	isString bool
+}
+
+//line ../input/main.go:12
+func IsIntKinds(x interface{}) bool    { _, ok := x.(int); return ok }
+//line ../input/main.go:12
+func IsStringKinds(x interface{}) bool { _, ok := x.(string); return ok }
+
+//line ../input/main.go:14
+func CountKinds() int { return 0 }
+`,
+	},
+	{
+		title:   "Declaration directives",
+		args:    "IntSet(int)",
+		pkg:     "main",
+		in:      directiveTest,
+		outName: "gotemplate_IntSet.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import "errors"
+
+// template type Set(A)
+
+// Set is a set of A
+type IntSetType struct{ a int }
+
+// ErrNotFound is returned when an element is missing
+var ErrNotFound = errors.New("not found")
+
+func helperIntSet() {}
+
+func newIntSet() *IntSetType { return &IntSetType{} }
+
+const (
+	limit = 10
+	other = 1
+)
+`,
+	},
+	{
+		title: "Test function",
+		args:  "Min(int8, func(a int8, b int8) bool { return a < b })",
+		pkg:   "main",
+		in: `package tt
+
+// template type TT(A, Less)
+type A int
+func Less(a, b A) bool { return a < b }
+
+func TT(a, b A) A {
+	if Less(a, b) {
+		return a
+	}
+	return b
+}
+`,
+		outName: "gotemplate_Min.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type TT(A, Less)
+
+func Min(a, b int8) int8 {
+	if func(a int8, b int8) bool {
+		return a < b
+	}(a, b) {
+		return a
+	}
+	return b
+}
+`,
+	},
+	{
+		title: "Simple Test constants",
+		args:  "Vector2(float32, 2)",
+		pkg:   "main",
+		in: `package tt
+
+// template type Vector(A, n)
+type A float32
+const n = 3
+
+type Vector [n]A
+
+func (v Vector) Add(b Vector) {
+	for i := range v {
+		v[i] += b[i]
+	}
+}
+`,
+		outName: "gotemplate_Vector2.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Vector(A, n)
+
+type Vector2 [2]float32
+
+func (v Vector2) Add(b Vector2) {
+	for i := range v {
+		v[i] += b[i]
+	}
+}
+`,
+	},
+	{
+		title: "Test constants",
+		args:  "Matrix22(float32, 2, 2)",
+		pkg:   "main",
+		in: `package mat
+
+// template type Matrix(A, n, m)
+type A float32
+
+const (
+	n, a, b, m = 1, 2, 3, 1
+)
+
+type Matrix [n][m]A
+
+func (mat Matrix) Add(x Matrix) {
+	for i := range mat {
+		for j := range mat[i] {
+			mat[i][j] += x[i][j]
+		}
+	}
+}
+`,
+		outName: "gotemplate_Matrix22.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Matrix(A, n, m)
+
+const (
+	aMatrix22, bMatrix22 = 2, 3
+)
+
+type Matrix22 [2][2]float32
+
+func (mat Matrix22) Add(x Matrix22) {
+	for i := range mat {
+		for j := range mat[i] {
+			mat[i][j] += x[i][j]
+		}
+	}
+}
+`,
+	},
+	{
+		title: "Test vars",
+		args:  "ProgXX(xx1, xx2, xx3, xx4, xx5, xx6)",
+		pkg:   "main",
+		files: map[string]string{
+			"output/xx.go": "package main\n\nvar xx1, xx2, xx3, xx4, xx5, xx6 int\n",
+		},
+		in: `package prog
+
+// template type Prog(a, b, c, d, e, f)
+type A float32
+
+var (
+	a, z = 1, 2
+	b, n, m, c = 3, 4, 5, 6
+	d = 7
+)
+
+var (
+	o = 8
+	e = 8
+)
+
+var (
+	oo = 9
+)
+
+var (
+	p, f, q = 11, 12, 13
+)
+
+func Prog() int {return a+b+c+d+e+f}
+`,
+		outName: "gotemplate_ProgXX.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Prog(a, b, c, d, e, f)
+type AProgXX float32
+
+var (
+	zProgXX          = 2
+	nProgXX, mProgXX = 4, 5
+)
+
+var (
+	oProgXX = 8
+)
+
+var (
+	ooProgXX = 9
+)
+
+var (
+	pProgXX, qProgXX = 11, 13
+)
+
+func ProgXX() int { return xx1 + xx2 + xx3 + xx4 + xx5 + xx6 }
+`,
+	},
+	{
+		title: "Test complex type decls",
+		args:  "tmpl(int, string, map[string]map[string]chan int, float32, rune, chan []string)",
+		pkg:   "main",
+		in: `package tt
+
+// template type TMPL(A, B, C, D, E, F)
+type A int
+
+type TMPL struct {
+	a A
+	b B
+	c C
+	d D
+	e E
+	f F
+}
+
+type ImportantType bool
+
+type (
+	ImportantType1 int
+	B struct {
+		v map[int][][][]rune
+	}
+	importantType2 map[int]int
+	C chan struct {
+		x []string
+	}
+)
+
+type (
+	D rune
+	importantType3 struct{}
+	E string
+	F map[string]int
+)
+`,
+		outName: "gotemplate_tmpl.go",
+		out: `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type TMPL(A, B, C, D, E, F)
+
+type tmpl struct {
+	a int
+	b string
+	c map[string]map[string]chan int
+	d float32
+	e rune
+	f chan []string
+}
+
+type importantTypeTmpl bool
+
+type (
+	importantType1Tmpl int
+
+	importantType2Tmpl map[int]int
+)
+
+type (
+	importantType3Tmpl struct{}
+)
+`,
+	},
+}
+
+// setupTest makes a GOPATH with the template in package input and
+// changes into the output package, returning its directory and a
+// function to clean up
+func setupTest(t *testing.T, in string, files map[string]string) (output string, cleanup func()) {
+	// Disable logging
+	log.SetOutput(ioutil.Discard)
+
+	// Make temporary directory
+	dir, err := ioutil.TempDir("", "gotemplate_test")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	cleanups := []func(){func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Logf("Failed to remove temp dir: %v", err)
+		}
+	}}
+	cleanup = func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	// Make subdirectories
+	src := path.Join(dir, "src")
+	err = os.Mkdir(src, 0700)
+	if err != nil {
+		t.Fatalf("Failed to make dir %q: %v", src, err)
+	}
+	input := path.Join(src, "input")
+	err = os.Mkdir(input, 0700)
+	if err != nil {
+		t.Fatalf("Failed to make dir %q: %v", input, err)
+	}
+	output = path.Join(src, "output")
+	err = os.Mkdir(output, 0700)
+	if err != nil {
+		t.Fatalf("Failed to make dir %q: %v", output, err)
+	}
+
+	// Change directory to output directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to read cwd: %v", err)
+	}
+	err = os.Chdir(output)
+	if err != nil {
+		t.Fatalf("Failed to cd %q dir: %v", output, err)
+	}
+	cleanups = append(cleanups, func() {
+		err := os.Chdir(cwd)
+		if err != nil {
+			t.Logf("Failed to change back to cwd: %v", err)
+		}
+	})
+
+	// Set GOPATH to directory
+	build.Default.GOPATH = dir
+	t.Setenv("GOPATH", dir)
+	t.Setenv("GO111MODULE", "off")
+
+	// Write template input
+	tmpl := path.Join(input, "main.go")
+	err = ioutil.WriteFile(tmpl, []byte(in), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write %q: %v", tmpl, err)
+	}
+
+	// Write main.go for output
+	main := path.Join(output, "main.go")
+	err = ioutil.WriteFile(main, []byte("package main"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write %q: %v", main, err)
+	}
+
+	// Write any extra files
+	for name, contents := range files {
+		file := path.Join(src, name)
+		err = os.MkdirAll(path.Dir(file), 0700)
+		if err != nil {
+			t.Fatalf("Failed to make dir for %q: %v", file, err)
+		}
+		err = ioutil.WriteFile(file, []byte(contents), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %q: %v", file, err)
+		}
+	}
+
+	return output, cleanup
+}
+
+// setupModuleTest is setupTest with GOPATH/src the root of the
+// module example.com at the go version in goVersion, so the template
+// is "example.com/input"
+func setupModuleTest(t *testing.T, goVersion, in string, files map[string]string) (output string, cleanup func()) {
+	output, cleanup = setupTest(t, in, files)
+	goMod := path.Join(path.Dir(output), "go.mod")
+	err := ioutil.WriteFile(goMod, []byte("module example.com\n\ngo "+goVersion+"\n"), 0600)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to write %q: %v", goMod, err)
+	}
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	return output, cleanup
+}
+
+// checkOutput checks the file name in the output directory contains
+// expected, showing a diff if not
+func checkOutput(t *testing.T, output, name, expected string) {
+	expectedFile := path.Join(output, name)
+	actualBytes, err := ioutil.ReadFile(expectedFile)
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", expectedFile, err)
+	}
+	actual := string(actualBytes)
+	if actual != expected {
+		t.Errorf(`Output is wrong
+Got
+-------------
+%s
+-------------
+Expected
+-------------
+%s
+-------------
+`, actual, expected)
+		actualFile := expectedFile + ".actual"
+		err = ioutil.WriteFile(actualFile, []byte(expected), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %q: %v", actualFile, err)
+		}
+		cmd := exec.Command("diff", "-u", actualFile, expectedFile)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		_ = cmd.Run()
+		t.Errorf("Diff\n----\n%s", out.String())
+	}
+}
+
+func testTemplate(t *testing.T, test *TestTemplate) {
+	output, cleanup := setupTest(t, test.in, test.files)
+	defer cleanup()
+
+	// Instantiate template
+	template := newTemplate(output, "input", test.args)
+	if test.naming != nil {
+		template.naming = *test.naming
+	}
+	template.lineDirectives = test.lines
+	template.instantiate()
+
+	// Check output
+	checkOutput(t, output, test.outName, test.out)
+}
+
+func TestSub(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	for i := range tests {
+		t.Logf("Test[%d] %q", i, tests[i].title)
+		testTemplate(t, &tests[i])
+	}
+}
+
+const sharedTest = `package tt
+
+// template type Sort(A)
+type A int
+
+func Sort(data []A) { swap(data, 0, min(1, len(data)-1)) }
+
+func swap(data []A, i, j int) { data[i], data[j] = data[j], data[i] }
+
+// min returns the smaller of a and b
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int { return -min(-a, -b) }
+
+func swapMin(data []A) { swap(data, 0, min(0, 1)) }
+`
+
+func TestShared(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, sharedTest, map[string]string{
+		"other/main.go": sharedTest,
+	})
+	defer cleanup()
+
+	for _, args := range []string{"SortInt(int)", "sortString(string)"} {
+		template := newTemplate(output, "input", args)
+		template.shareHelpers = true
+		template.instantiate()
+	}
+
+	checkOutput(t, output, "gotemplate_sortString.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Sort(A)
+
+func sortString(data []string) { swapSortString(data, 0, minSharedSort(1, len(data)-1)) }
+
+func swapSortString(data []string, i, j int) { data[i], data[j] = data[j], data[i] }
+
+func swapMinSortString(data []string) { swapSortString(data, 0, minSharedSort(0, 1)) }
+`)
+	checkOutput(t, output, "gotemplate_shared_Sort.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+//gotemplate:template input
+
+//gotemplate:users gotemplate_SortInt.go gotemplate_sortString.go
+func maxSharedSort(a, b int) int { return -minSharedSort(-a, -b) }
+
+// min returns the smaller of a and b
+//
+//gotemplate:users gotemplate_SortInt.go gotemplate_sortString.go
+func minSharedSort(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+`)
+
+	// Removing an instance should prune it from the users
+	err := os.Remove(path.Join(output, "gotemplate_SortInt.go"))
+	if err != nil {
+		t.Fatalf("Failed to remove instance: %v", err)
+	}
+	template := newTemplate(output, "input", "sortString(string)")
+	template.shareHelpers = true
+	template.instantiate()
+	checkOutput(t, output, "gotemplate_shared_Sort.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+//gotemplate:template input
+
+//gotemplate:users gotemplate_sortString.go
+func maxSharedSort(a, b int) int { return -minSharedSort(-a, -b) }
+
+// min returns the smaller of a and b
+//
+//gotemplate:users gotemplate_sortString.go
+func minSharedSort(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+`)
+
+	// Another template called Sort can't share the same file
+	message := expectFatal(t, func() {
+		template := newTemplate(output, "other", "SortFloat(float64)")
+		template.shareHelpers = true
+		template.instantiate()
+	})
+	if !strings.Contains(message, `shared by the template Sort from "input" so can't share those of Sort from "other"`) {
+		t.Errorf("Wrong error: %s", message)
+	}
+}
+
+// A specialization's helper differing from the shared one is kept in
+// its instance
+func TestSharedSpecialized(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Box(A)
+type A int
+
+type Box struct{ a A }
+
+func (b Box) Describe() string { return describe() + " " + name() }
+
+func describe() string { return "generic" }
+
+func name() string { return "box" }
+`, map[string]string{
+		"input/box_string.go": `//go:build ignore
+
+package tt
+
+// template type Box(A)
+// template specialize Box(string)
+type A string
+
+type Box struct{ a A }
+
+func (b Box) Describe() string { return describe() + " " + name() }
+
+func describe() string { return "string" }
+
+func name() string { return "box" }
+`,
+		"output/main.go": `package main
+
+import "fmt"
+
+func main() { fmt.Println(IntBox{}.Describe(), StrBox{}.Describe()) }
+`,
+	})
+	defer cleanup()
+
+	for _, args := range []string{"IntBox(int)", "StrBox(string)"} {
+		template := newTemplate(output, "input", args)
+		template.shareHelpers = true
+		template.instantiate()
+	}
+	checkOutput(t, output, "gotemplate_StrBox.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Box(A)
+// template specialize Box(string)
+
+type StrBox struct{ a string }
+
+func (b StrBox) Describe() string { return describeStrBox() + " " + nameSharedBox() }
+
+func describeStrBox() string { return "string" }
+`)
+	checkOutput(t, output, "gotemplate_shared_Box.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+//gotemplate:template input
+
+//gotemplate:users gotemplate_IntBox.go
+func describeSharedBox() string { return "generic" }
+
+//gotemplate:users gotemplate_IntBox.go gotemplate_StrBox.go
+func nameSharedBox() string { return "box" }
+`)
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err != nil || string(out) != "generic box string box\n" {
+		t.Errorf("Wrong output %v: %s", err, out)
+	}
+}
+
+const collisionTest = `package tt
+
+// template type Set(A)
+type A int
+
+type Set struct{ a A }
+
+func utilityFunc() Set { return Set{} }
+
+func other() {}
+`
+
+var collisionFiles = map[string]string{
+	"output/other.go": "package main\n\nfunc utilityFuncMySet() {}\n\ntype otherMySet int\n",
+}
+
+func TestVariadicCollisions(t *testing.T) {
+	output, cleanup := setupTest(t, `package tt
+
+// template type Checks(A...)
+type A int
+
+type Checks []bool
+
+// template repeat
+func IsA(x interface{}) bool { _, ok := x.(A); return ok }
+`, map[string]string{
+		"output/other.go": "package main\n\nfunc IsIntKinds() {}\n",
+	})
+	defer cleanup()
+
+	message := expectFatal(t, func() {
+		newTemplate(output, "input", "Kinds(string, int)").instantiate()
+	})
+	if !strings.Contains(message, "IsIntKinds collides with the declaration at") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+}
+
+func TestSpecializationAmbiguous(t *testing.T) {
+	output, cleanup := setupTest(t, specializeTest, map[string]string{
+		"input/pair_bool.go": specializeFiles["input/pair_bool.go"],
+		"input/pair_string.go": `//go:build ignore
+
+package tt
+
+// template type Pair(A, B)
+// template specialize Pair(_, string)
+type A int
+type B string
+
+type Pair struct{ b B }
+`,
+	})
+	defer cleanup()
+
+	message := expectFatal(t, func() {
+		newTemplate(output, "input", "PairBS(bool, string)").instantiate()
+	})
+	if !strings.Contains(message, `More than one specialization of "input" matches PairBS(bool, string) equally well`) {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+
+	// Only one of them matches these
+	newTemplate(output, "input", "PairIS(int, string)").instantiate()
+	checkOutput(t, output, "gotemplate_PairIS.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Pair(A, B)
+// template specialize Pair(_, string)
+
+type PairIS struct{ b string }
+`)
+}
+
+// expectFatal runs fn checking it calls fatalf, returning the message
+func expectFatal(t *testing.T, fn func()) string {
+	err := catchFatal(fn)
+	if err == nil {
+		t.Fatalf("Expecting fatal error")
+	}
+	return err.Error()
+}
+
+func TestCollisions(t *testing.T) {
+	output, cleanup := setupTest(t, collisionTest, collisionFiles)
+	defer cleanup()
+
+	message := expectFatal(t, func() {
+		newTemplate(output, "input", "mySet(int)").instantiate()
+	})
+	if !strings.Contains(message, "Found 2 name collisions") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+
+	// Run twice to check the existing output isn't a collision
+	for i := 0; i < 2; i++ {
+		template := newTemplate(output, "input", "mySet(int)")
+		template.collisionSuffix = "Gen"
+		template.naming.renames["other"] = "otherSet"
+		template.instantiate()
+	}
+	checkOutput(t, output, "gotemplate_mySet.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type mySet struct{ a int }
+
+func utilityFuncMySetGen() mySet { return mySet{} }
+
+func otherSet() {}
+`)
+}
+
+func TestBadRenames(t *testing.T) {
+	output, cleanup := setupTest(t, namingTest, nil)
+	defer cleanup()
+
+	for _, test := range []struct {
+		from, to string
+		want     string
+	}{
+		{"missing", "other", "Can't rename missing as the template doesn't declare it"},
+		{"NewSet", "Make-Set", `Can't rename NewSet to "Make-Set" as it isn't an identifier`},
+	} {
+		message := expectFatal(t, func() {
+			template := newTemplate(output, "input", "mySet(int)")
+			template.naming.renames[test.from] = test.to
+			template.instantiate()
+		})
+		if !strings.Contains(message, test.want) {
+			t.Errorf("Wrong fatal error: %q", message)
+		}
+	}
+}
+
+func TestArgImports(t *testing.T) {
+	output, cleanup := setupTest(t, argImportTest, argImportFiles)
+	defer cleanup()
+
+	template := newTemplate(output, "input", "UserStore(m.User)")
+	template.importFlags["m"] = "app/model"
+	template.instantiate()
+	checkOutput(t, output, "gotemplate_UserStore.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	m "app/model"
+	"model"
+)
+
+// template type Store(A)
+
+type UserStore struct {
+	items   []m.User
+	version model.Version
+}
+
+func (s *UserStore) Has(a m.User) bool {
+	for _, item := range s.items {
+		if item == a {
+			return true
+		}
+	}
+	return false
+}
+`)
+
+	// Packages aren't named after names declared in the destination
+	err := ioutil.WriteFile(path.Join(output, "vars.go"), []byte("package main\n\nvar http = 1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTemplate(output, "input", `HeaderStore("net/http".Header)`).instantiate()
+	checkOutput(t, output, "gotemplate_HeaderStore.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	"model"
+	http2 "net/http"
+)
+
+// template type Store(A)
+
+type HeaderStore struct {
+	items   []http2.Header
+	version model.Version
+}
+`)
+
+	for _, test := range []struct {
+		args     string
+		imports  map[string]string
+		expected string
+	}{
+		{"UserStore(model.User)", map[string]string{"model": "app/model"}, `Can't import "app/model" as model as the template imports "model" as model`},
+		{"UserStore(x.User)", map[string]string{"x": "missing"}, `Package "missing" for -import x not found`},
+		{`UserStore("missing".User)`, nil, `Package "missing" in argument "missing".User not found`},
+		{"HeaderStore(http.Header)", map[string]string{"http": "net/http"}, `Can't import "net/http" as http as http is declared at `},
+	} {
+		message := expectFatal(t, func() {
+			template := newTemplate(output, "input", test.args)
+			for alias, importPath := range test.imports {
+				template.importFlags[alias] = importPath
+			}
+			template.instantiate()
+		})
+		if !strings.Contains(message, test.expected) {
+			t.Errorf("%s: wrong fatal error: %q", test.args, message)
+		}
+	}
+}
+
+func TestReplaceImportPaths(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		out     string
+		imports []string
+	}{
+		{`Set(int)`, `Set(int)`, nil},
+		{`Set("x.y/a".T, "b")`, `Set(_gotemplateImport0.T, "b")`, []string{"x.y/a"}},
+		{"Map(map[`a`.K][]*\"b/c\".V)", `Map(map[_gotemplateImport0.K][]*_gotemplateImport1.V)`, []string{"a", "b/c"}},
+	} {
+		out, imports := replaceImportPaths(test.in)
+		if out != test.out || fmt.Sprint(imports) != fmt.Sprint(test.imports) {
+			t.Errorf("%s: got %q %q expecting %q %q", test.in, out, imports, test.out, test.imports)
+		}
+	}
+}
+
+const genericTest = `package tt
+
+// template type Box(A)
+type A int
+
+type Box struct {
+	A
+	ptr *A
+}
+
+func NewBox(a A) Box { return Box{A: a} }
+
+func (b Box) Get() A { return b.A }
+
+func (b Box) Convert(x A) A { return A(x) }
+
+// template if comparable(A)
+func (b Box) Is(a A) bool { return b.A == a }
+
+// template end
+`
+
+var genericFiles = map[string]string{
+	"output/types.go": `package main
+
+type Pair[K comparable, V any] struct {
+	k K
+	v V
+}
+
+type Option[T any] struct{ v *T }
+`,
+	"tree/tree.go": `package tree
+
+// template type Tree(K, V)
+type K int
+type V int
+
+type Tree struct{ nodes map[K]V }
+
+func (t Tree) Get(k K) V { return t.nodes[k] }
+`,
+	"method/method.go": `package method
+
+// template type Value(A)
+type A int
+
+type Value struct{ a A }
+
+func (a A) String() string { return "" }
+`,
+}
+
+func TestGenericArgs(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupModuleTest(t, "1.18", genericTest, genericFiles)
+	defer cleanup()
+
+	for _, test := range []struct {
+		pkg  string
+		args string
+		out  string
+	}{
+		{"example.com/input", "PairBox(Pair[int, string])", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Box(A)
+
+type PairBox struct {
+	Pair[int, string]
+	ptr *Pair[int, string]
+}
+
+func NewPairBox(a Pair[int, string]) PairBox { return PairBox{Pair: a} }
+
+func (b PairBox) Get() Pair[int, string] { return b.Pair }
+
+func (b PairBox) Convert(x Pair[int, string]) Pair[int, string] { return Pair[int, string](x) }
+
+func (b PairBox) Is(a Pair[int, string]) bool { return b.Pair == a }
+`},
+		{"example.com/input", "OptionBox(*Option[Pair[int, string]])", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Box(A)
+
+type OptionBox struct {
+	*Option[Pair[int, string]]
+	ptr **Option[Pair[int, string]]
+}
+
+func NewOptionBox(a *Option[Pair[int, string]]) OptionBox { return OptionBox{Option: a} }
+
+func (b OptionBox) Get() *Option[Pair[int, string]] { return b.Option }
+
+func (b OptionBox) Convert(x *Option[Pair[int, string]]) *Option[Pair[int, string]] {
+	return (*Option[Pair[int, string]])(x)
+}
+
+func (b OptionBox) Is(a *Option[Pair[int, string]]) bool { return b.Option == a }
+`},
+		{"example.com/tree", "OptionTree(Pair[string, int], Option[string])", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Tree(K, V)
+
+type OptionTree struct {
+	nodes map[Pair[string, int]]Option[string]
+}
+
+func (t OptionTree) Get(k Pair[string, int]) Option[string] { return t.nodes[k] }
+`},
+	} {
+		template := newTemplate(output, test.pkg, test.args)
+		template.instantiate()
+		checkOutput(t, output, template.outputFileName(), test.out)
+	}
+
+	// The instances should compile
+	cmd := exec.Command("go", "vet", ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Instances don't compile: %v\n%s", err, out)
+	}
+
+	// Methods on an instantiated generic type can't be made
+	err := catchFatal(func() {
+		newTemplate(output, "example.com/method", "PairValue(Pair[int, int])").instantiate()
+	})
+	if err == nil || !strings.Contains(err.Error(), "Can't make method String on Pair[int, int]") {
+		t.Errorf("Expecting error about the method but got %v", err)
+	}
+}
+
+const aliasTest = `package tt
+
+// template type List(A)
+type A = int
+
+type List struct {
+	A
+	items []A
+}
+
+type Items = []A
+
+type Mapper[T any] func(A) T
+
+func mapSlice[T any](xs []A, f func(A) T) []T {
+	out := make([]T, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+
+type pair[K comparable, V any] struct {
+	k K
+	v V
+}
+
+func (p pair[K, V]) Key() K { return p.k }
+
+func (l List) Strings(f Mapper[string]) []string { return mapSlice(l.items, f) }
+
+func (l List) Items() Items { return l.items }
+
+func (l List) First() A { return l.A }
+
+func (l List) Pair() pair[A, int] { return pair[A, int]{k: l.A} }
+
+func keys[K comparable, V any](m map[K]V) []K {
+	var out []K
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
+func (l List) Keys(m map[A]bool) []A { return keys(m) }
+`
+
+func TestGenericTemplate(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupModuleTest(t, "1.18", aliasTest, map[string]string{
+		"output/t.go": "package main\n\ntype T float32\n",
+	})
+	defer cleanup()
+
+	newTemplate(output, "example.com/input", "FloatList(float64)").instantiate()
+	checkOutput(t, output, "gotemplate_FloatList.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type List(A)
+
+type FloatList struct {
+	float64
+	items []float64
+}
+
+type ItemsFloatList = []float64
+
+type MapperFloatList[T any] func(float64) T
+
+func mapSliceFloatList[T any](xs []float64, f func(float64) T) []T {
+	out := make([]T, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+
+type pairFloatList[K comparable, V any] struct {
+	k K
+	v V
+}
+
+func (p pairFloatList[K, V]) Key() K { return p.k }
+
+func (l FloatList) Strings(f MapperFloatList[string]) []string { return mapSliceFloatList(l.items, f) }
+
+func (l FloatList) Items() ItemsFloatList { return l.items }
+
+func (l FloatList) First() float64 { return l.float64 }
+
+func (l FloatList) Pair() pairFloatList[float64, int] {
+	return pairFloatList[float64, int]{k: l.float64}
+}
+
+func keysFloatList[K comparable, V any](m map[K]V) []K {
+	var out []K
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
+func (l FloatList) Keys(m map[float64]bool) []float64 { return keysFloatList(m) }
+`)
+
+	// Generic helpers can be shared between instances too
+	for _, args := range []string{"stringList(string)", "byteList(byte)"} {
+		template := newTemplate(output, "example.com/input", args)
+		template.shareHelpers = true
+		template.instantiate()
+	}
+	shared, err := ioutil.ReadFile(path.Join(output, "gotemplate_shared_List.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(shared), "func keysSharedList[K comparable, V any](m map[K]V) []K {") || strings.Contains(string(shared), "func mapSlice") {
+		t.Errorf("Wrong helpers shared:\n%s", shared)
+	}
+
+	// Type parameters don't capture the arguments
+	newTemplate(output, "example.com/input", "TList(T)").instantiate()
+	instance, err := ioutil.ReadFile(path.Join(output, "gotemplate_TList.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(instance), "func mapSliceTList[T2 any](xs []T, f func(T) T2) []T2 {") {
+		t.Errorf("Type parameter not renamed:\n%s", instance)
+	}
+
+	cmd := exec.Command("go", "vet", ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Instances don't compile: %v\n%s", err, out)
+	}
+
+	var out bytes.Buffer
+	describe(&out, output, "example.com/input")
+	expected := `Template List(A) in ` + path.Join(path.Dir(output), "input", "main.go") + `
+
+Parameters:
+  A  type alias
+
+Declarations:
+  List      type
+  Items     type alias
+  Mapper    generic type
+  mapSlice  generic func
+  pair      generic type
+  keys      generic func
+`
+	if out.String() != expected {
+		t.Errorf("Wrong description\nGot\n%s\nExpected\n%s", out.String(), expected)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, directiveTest, nil)
+	defer cleanup()
+
+	var out bytes.Buffer
+	describe(&out, output, "input")
+	expected := `Template Set(A) in ` + path.Join(path.Dir(output), "input", "main.go") + `
+
+Parameters:
+  A  type
+
+Declarations:
+  Set          type   name {{Name}}Type
+  ErrNotFound  var    keep
+  Helper       func   private
+  Make         func   name New{{Name}}, private
+  limit        const  keep
+  Other        const  keep, private
+`
+	if out.String() != expected {
+		t.Errorf("Wrong description\nGot\n%s\nExpected\n%s", out.String(), expected)
+	}
+}
+
+var generateFiles = map[string]string{
+	"output/gotemplate.json": `{
+	"instances": [
+		{"template": "input", "instance": "mySet(int)", "naming": "prefix"},
+		{
+			"template": "input",
+			"instance": "StringSet(string)",
+			"dir": "sub",
+			"output": "set_gen.go",
+			"package": "sub",
+			"export": "private",
+			"rename": {"NewSet": "makeSet"}
+		}
+	]
+}
+`,
+	"output/sub/.keep": "",
+}
+
+func TestGenerate(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, namingTest, generateFiles)
+	defer cleanup()
+
+	generate(path.Join(output, "sub"), "", opts, 1)
+
+	checkOutput(t, output, "gotemplate_mySet.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+// template type Set(A)
+
+type mySet struct{ a int }
+
+func newMySet() *mySet { return &mySet{} }
+
+func mySetUtilityFunc() {}
+
+func mySetExported() {}
+
+var mySetCount int
+
+const mySetMax = 1
+`)
+	checkOutput(t, output, "sub/set_gen.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package sub
+
+// template type Set(A)
+
+type stringSet struct{ a string }
+
+func makeSet() *stringSet { return &stringSet{} }
+
+func utilityFuncStringSet() {}
+
+func exportedStringSet() {}
+
+var countStringSet int
+
+const maxStringSet = 1
+`)
+}
+
+func TestGenerateParallel(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	var instances []string
+	for _, name := range []string{"aSet", "bSet", "cSet", "dSet", "eSet", "fSet"} {
+		instances = append(instances, `{"template": "input", "instance": "`+name+`(int)", "shared": true}`)
+	}
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"output/gotemplate.json": `{"instances": [` + strings.Join(instances, ",\n") + `]}`,
+	})
+	defer cleanup()
+	readOutputs := func(remove bool) map[string]string {
+		names, _ := filepath.Glob(path.Join(output, "gotemplate_*.go"))
+		outputs := map[string]string{}
+		for _, name := range names {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("Failed to read %q: %v", name, err)
+			}
+			outputs[path.Base(name)] = string(data)
+			if remove {
+				_ = os.Remove(name)
+			}
+		}
+		return outputs
+	}
+	compare := func(what string, got, want map[string]string) {
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d files want %d", what, len(got), len(want))
+		}
+		for name, data := range want {
+			if got[name] != data {
+				t.Errorf("%s: %s differs\nGot\n%s\nExpected\n%s", what, name, got[name], data)
+			}
+		}
+	}
+
+	generate(output, "", opts, 1)
+	want := readOutputs(true)
+	if len(want) != len(instances)+1 {
+		t.Fatalf("Expecting %d files but got %d", len(instances)+1, len(want))
+	}
+	generate(output, "", opts, 4)
+	compare("new files", readOutputs(false), want)
+	generate(output, "", opts, 4)
+	compare("existing files", readOutputs(true), want)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"output/gotemplate.json": `{"instances": [
+	{"template": "input", "instance": "aSet(int)"},
+	{"template": "missing", "instance": "bSet(int)"},
+	{"template": "input", "instance": "cSet(int)"},
+	{"template": "input", "instance": "dSet(int, string)"}
+]}`,
+		"output/dup/gotemplate.json": `{"instances": [
+	{"template": "input", "instance": "aSet(int)", "output": "set.go", "package": "dup"},
+	{"template": "input", "instance": "bSet(int)", "output": "set.go", "package": "dup"}
+]}`,
+		"output/clash/gotemplate.json": `{"instances": [
+	{"template": "input", "instance": "aSet(int)", "output": "int.go", "package": "clash"},
+	{"template": "input", "instance": "aSet(string)", "output": "string.go", "package": "clash"}
+]}`,
+	})
+	defer cleanup()
+
+	// All the errors are reported in order
+	message := expectFatal(t, func() {
+		generate(output, "", opts, 4)
+	})
+	second, fourth := strings.Index(message, "instance 2: "), strings.Index(message, "instance 4: ")
+	if second < 0 || fourth < second || strings.Contains(message, "instance 1:") || strings.Contains(message, "instance 3:") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+	if _, err := os.Stat(path.Join(output, "gotemplate_cSet.go")); err != nil {
+		t.Errorf("Instance after an error not generated: %v", err)
+	}
+
+	message = expectFatal(t, func() {
+		generate(path.Join(output, "dup"), "", opts, 4)
+	})
+	if !strings.Contains(message, "instances 1 and 2 are both written to") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+
+	// New instances see each other's names
+	message = expectFatal(t, func() {
+		generate(path.Join(output, "clash"), "", opts, 4)
+	})
+	if !strings.Contains(message, "instance 2: ") || strings.Contains(message, "instance 1:") || !strings.Contains(message, "aSet collides with the declaration at") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+	if _, err := os.Stat(path.Join(output, "clash", "string.go")); err == nil {
+		t.Errorf("Colliding instance was written")
+	}
+}
+
+func TestLock(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"output/gotemplate.json": `{"instances": [
+	{"template": "input", "instance": "mySet(int)"},
+	{"template": "../input", "instance": "yourSet(int)"}
+]}`,
+	})
+	defer cleanup()
+	lockFile := path.Join(output, lockFileName)
+	readLockFile := func() string {
+		data, err := ioutil.ReadFile(lockFile)
+		if err != nil {
+			t.Fatalf("Failed to read lock file: %v", err)
+		}
+		return string(data)
+	}
+
+	// The lock is created on the first run
+	generate(output, "", opts, 1)
+	lock := readLockFile()
+	if !strings.HasPrefix(lock, "input (devel) h1:") || strings.Count(lock, "\n") != 1 {
+		t.Fatalf("Bad lock file %q", lock)
+	}
+
+	// Changing the template should stop generation
+	templateFile := path.Join(path.Dir(output), "input", "main.go")
+	err := ioutil.WriteFile(templateFile, []byte(namingTest+"\nfunc Another() {}\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to change template: %v", err)
+	}
+	message := expectFatal(t, func() {
+		generate(output, "", opts, 1)
+	})
+	if !strings.Contains(message, "use -update-lock") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+	if readLockFile() != lock {
+		t.Errorf("Lock file changed without -update-lock")
+	}
+
+	// Unless the lock is being updated
+	opts.updateLock = true
+	defer func() { opts.updateLock = false }()
+	generate(output, "", opts, 1)
+	if newLock := readLockFile(); newLock == lock || !strings.HasPrefix(newLock, "input (devel) h1:") {
+		t.Errorf("Lock file not updated properly: %q", newLock)
+	}
+}
+
+func TestCache(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, namingTest, nil)
+	defer cleanup()
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	cacheDir := cacheDir()
+	instantiate := func(in, args string) []byte {
+		err := ioutil.WriteFile(path.Join(path.Dir(output), "input", "main.go"), []byte(in), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write template: %v", err)
+		}
+		tt := newTemplate(output, "input", args)
+		tt.cache = true
+		tt.instantiate()
+		outputFile := path.Join(output, tt.outputFileName())
+		b, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if err := os.Remove(outputFile); err != nil {
+			t.Fatalf("Failed to remove output: %v", err)
+		}
+		return b
+	}
+	entries := func() []string {
+		names, _ := filepath.Glob(path.Join(cacheDir, "*"))
+		return names
+	}
+
+	// The first instantiation fills the cache
+	want := instantiate(namingTest, "mySet(int)")
+	cached := entries()
+	if len(cached) != 1 {
+		t.Fatalf("Expecting 1 cache entry but got %v", cached)
+	}
+	b, err := ioutil.ReadFile(cached[0])
+	if err != nil {
+		t.Fatalf("Failed to read cache: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("Cache entry differs from output")
+	}
+
+	// The second one comes from the cache
+	marker := []byte("package main\n\n// from the cache\n")
+	if err := ioutil.WriteFile(cached[0], marker, 0600); err != nil {
+		t.Fatalf("Failed to write cache: %v", err)
+	}
+	if got := instantiate(namingTest, "mySet(int)"); !bytes.Equal(got, marker) {
+		t.Errorf("Output not read from cache: %q", got)
+	}
+
+	// Different arguments or templates miss the cache
+	if got := instantiate(namingTest, "mySet(string)"); bytes.Equal(got, marker) {
+		t.Errorf("Different arguments read from cache")
+	}
+	if got := instantiate(namingTest+"\nfunc Another() {}\n", "mySet(int)"); bytes.Equal(got, marker) {
+		t.Errorf("Changed template read from cache")
+	}
+	if n := len(entries()); n != 3 {
+		t.Errorf("Expecting 3 cache entries but got %d", n)
+	}
+
+	// Results which depend on the destination package aren't cached
+	instantiate(conditionalTest, "IntSet(int)")
+	if n := len(entries()); n != 3 {
+		t.Errorf("Expecting 3 cache entries but got %d", n)
+	}
+
+	// Names added to the destination package since are collisions
+	other := path.Join(output, "other.go")
+	if err := ioutil.WriteFile(other, []byte("package main\n\nvar mySet int\n"), 0600); err != nil {
+		t.Fatalf("Failed to write destination: %v", err)
+	}
+	message := expectFatal(t, func() {
+		instantiate(namingTest, "mySet(int)")
+	})
+	if !strings.Contains(message, "mySet collides with the declaration at") {
+		t.Errorf("Wrong fatal error: %q", message)
+	}
+	if err := os.Remove(other); err != nil {
+		t.Fatalf("Failed to remove destination: %v", err)
+	}
+}
+
+const coverTest = `package tt
+
+// template type Set(A)
+type A int
+
+// Set is a set of A
+type Set map[A]struct{}
+
+// Add adds a to the set
+func (s Set) Add(a A) {
+	s[a] = struct{}{}
+}
+
+// Has returns whether a is in the set
+func (s Set) Has(a A) bool {
+	if _, found := Set(s)[a]; found {
+		return true
+	}
+	return false
+}
+
+// Len returns the size of the set
+func (s Set) Len() int {
+	return len(s)
+}
+`
+
+func TestCover(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, coverTest, map[string]string{
+		"output/gen.go": "package main\n\n//go:generate gotemplate \"input\" \"intSet(int)\"\n//go:generate gotemplate -naming prefix \"input\" \"StringSet(string)\"\n",
+		"output/main_test.go": `package main
+
+import "testing"
+
+func TestSets(t *testing.T) {
+	s := intSet{}
+	s.Add(1)
+	s.Has(1)
+	StringSet{}.Has("x")
+}
+`,
+	})
+	defer cleanup()
+	w := newWatcher(output, nil)
+	for _, instance := range w.instances {
+		instance.newTemplate().instantiate()
+	}
+	cmd := exec.Command("go", "test", "-coverprofile=cover.out", ".")
+	cmd.Dir = output
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test failed: %v\n%s", err, out)
+	}
+
+	var b bytes.Buffer
+	coverage(&b, output, []string{path.Join(output, "cover.out")})
+	profileFile := path.Join(output, "template.out")
+	if err := ioutil.WriteFile(profileFile, b.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	profiles, err := cover.ParseProfiles(profileFile)
+	if err != nil {
+		t.Fatalf("Bad profile %q: %v", b.String(), err)
+	}
+	var profile *cover.Profile
+	for _, p := range profiles {
+		if strings.Contains(p.FileName, "gotemplate_") {
+			t.Errorf("Instance %s not mapped", p.FileName)
+		} else if p.FileName == "input/main.go" {
+			profile = p
+		}
+	}
+	if profile == nil {
+		t.Fatalf("No profile for the template in %q", b.String())
+	}
+
+	// Each line with a statement is covered by one block with
+	// the coverage from all the instances
+	lines := strings.Split(coverTest, "\n")
+	expected := map[string]int{
+		"s[a] = struct{}{}":                 1,
+		"if _, found := Set(s)[a]; found {": 1,
+		"return true":                       1,
+		"return false":                      1,
+		"return len(s)":                     0,
+	}
+	for statement, count := range expected {
+		found := 0
+		for _, block := range profile.Blocks {
+			if strings.TrimSpace(lines[block.StartLine-1]) == statement {
+				found++
+				if block.Count != count {
+					t.Errorf("%q: count %d, expecting %d", statement, block.Count, count)
+				}
+				if text := lines[block.StartLine-1][block.StartCol-1:]; text != statement {
+					t.Errorf("%q: block starts in the wrong column at %q", statement, text)
+				}
+			}
+		}
+		if found != 1 {
+			t.Errorf("%q: expecting 1 block but found %d in %q", statement, found, b.String())
+		}
+	}
+}
+
+func TestCoverRepeats(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	in := `package tt
+
+// template type Checks(A...)
+type A int
+
+type Checks struct{}
+
+// template repeat
+func IsA(x interface{}) bool {
+	_, ok := x.(A)
+	return ok
+}
+`
+	output, cleanup := setupTest(t, in, map[string]string{
+		"output/gen.go": "package main\n\n//go:generate gotemplate \"input\" \"Kinds(int, string)\"\n",
+		"output/main_test.go": `package main
+
+import "testing"
+
+func TestKinds(t *testing.T) {
+	IsIntKinds(1)
+}
+`,
+	})
+	defer cleanup()
+	w := newWatcher(output, nil)
+	for _, instance := range w.instances {
+		instance.newTemplate().instantiate()
+	}
+	cmd := exec.Command("go", "test", "-coverprofile=cover.out", ".")
+	cmd.Dir = output
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test failed: %v\n%s", err, out)
+	}
+
+	var b bytes.Buffer
+	coverage(&b, output, []string{path.Join(output, "cover.out")})
+
+	// Both copies of the repeated function map onto it
+	blocks := 0
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.Contains(line, "gotemplate_") {
+			t.Errorf("Instance not mapped: %s", line)
+		}
+		if strings.HasPrefix(line, "input/main.go:10.2,") {
+			blocks++
+			if !strings.HasSuffix(line, " 2 1") {
+				t.Errorf("Wrong coverage %q", line)
+			}
+		}
+	}
+	if blocks != 1 {
+		t.Errorf("Expecting 1 block for IsA but found %d in %q", blocks, b.String())
+	}
+}
+
+func TestAnalyzer(t *testing.T) {
+	defer raiseFatal()()
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"output/gen.go": `package main
+
+//go:generate gotemplate "input" "mySet(int)"
+//go:generate gotemplate "input" "yourSet(int)"
+//go:generate gotemplate "input" "badSet(Unknown)"
+//go:generate gotemplate "input" "twoSet(int, int)"
+//go:generate gotemplate "missing" "xSet(int)"
+//go:generate gotemplate "input" "ySet(int"
+//go:generate gotemplate "input" "staleSet(string)"
+//go:generate gotemplate "input" "valueSet(1)"
+//go:generate gotemplate -bad "input" "flagSet(int)"
+//go:generate gotemplate "input" "pathSet(\"missing\".T)"
+//go:generate gotemplate generate
+`,
+		"output/time.go": `package main
+
+import "time"
+
+var start time.Time
+
+//go:generate gotemplate "input" "timeSet(time.Time)"
+//go:generate gotemplate "input" "urlSet(*url.URL)"
+`,
+	})
+	defer cleanup()
+	newTemplate(output, "input", "mySet(int)").instantiate()
+	newTemplate(output, "input", "timeSet(time.Time)").instantiate()
+	newTemplate(output, "input", "urlSet(*url.URL)").instantiate()
+	newTemplate(output, "input", "staleSet(string)").instantiate()
+	staleFile := path.Join(output, "gotemplate_staleSet.go")
+	stale, err := ioutil.ReadFile(staleFile)
+	if err != nil {
+		t.Fatalf("Failed to read instance: %v", err)
+	}
+	if err := ioutil.WriteFile(staleFile, append(stale, "\n// changed\n"...), 0600); err != nil {
+		t.Fatalf("Failed to write instance: %v", err)
+	}
+
+	pkgs, err := packages.Load(&packages.Config{Mode: packages.LoadAllSyntax, Dir: output}, ".")
+	if err != nil || len(pkgs) != 1 || len(pkgs[0].Errors) != 0 {
+		t.Fatalf("Failed to load package: %v %v", err, pkgs)
+	}
+	pkg := pkgs[0]
+	var diagnostics []string
+	pass := &analysis.Pass{
+		Analyzer:   Analyzer,
+		Fset:       pkg.Fset,
+		Files:      pkg.Syntax,
+		Pkg:        pkg.Types,
+		TypesInfo:  pkg.TypesInfo,
+		TypesSizes: pkg.TypesSizes,
+		Report: func(d analysis.Diagnostic) {
+			diagnostics = append(diagnostics, fmt.Sprintf("%d: %s", pkg.Fset.Position(d.Pos).Line, d.Message))
+		},
+	}
+	if _, err := Analyzer.Run(pass); err != nil {
+		t.Fatalf("Analyzer failed: %v", err)
+	}
+
+	expected := []string{
+		"4: gotemplate_yourSet.go doesn't exist",
+		`5: Argument "Unknown" for A doesn't type check`,
+		"6: Wrong number of arguments",
+		"7: Import missing failed",
+		`8: Failed to parse "ySet(int"`,
+		"9: gotemplate_staleSet.go is out of date",
+		`10: Argument "1" for A is not a type`,
+		"11: flag provided but not defined: -bad",
+		`12: Package "missing" in argument "missing".T not found`,
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Expecting %d diagnostics but got %d: %q", len(expected), len(diagnostics), diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if !strings.HasPrefix(diagnostic, expected[i]) {
+			t.Errorf("Diagnostic %d: got %q expecting %q", i, diagnostic, expected[i])
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"bad/main.go": "package bad\n\n// template type Bad(A)\ntype A int\n\nvar x int = \"a\"\n\nfunc f() { undefined() }\n",
+	})
+	defer cleanup()
+	var b bytes.Buffer
+	*jsonOutput, eventOutput, testingMode = true, &b, false
+	defer func() {
+		*jsonOutput, eventOutput, testingMode = false, os.Stdout, true
+	}()
+
+	newTemplate(output, "input", "mySet(int)").instantiate()
+	newTemplate(output, "input", "mySet(int)").instantiate()
+	// As run from the command line
+	if err := commandLine.Parse([]string{"bad", "badInt(int)"}); err != nil {
+		t.Fatalf("Failed to parse command line: %v", err)
+	}
+	defer func() { _ = commandLine.Parse(nil) }()
+	err := catchFatal(run)
+	if err == nil {
+		t.Fatalf("Expecting type checking error")
+	}
+	emitError(err)
+
+	var events []event
+	decoder := json.NewDecoder(&b)
+	for decoder.More() {
+		var e event
+		if err := decoder.Decode(&e); err != nil {
+			t.Fatalf("Bad JSON in %q: %v", b.String(), err)
+		}
+		events = append(events, e)
+	}
+	outputFile := path.Join(output, "gotemplate_mySet.go")
+	expected := []event{
+		{Action: actionStart, Template: "input", Instance: "mySet(int)", File: outputFile},
+		{Action: actionWrite, File: outputFile},
+		{Action: actionStart, Template: "input", Instance: "mySet(int)", File: outputFile},
+		{Action: actionUnchanged, File: outputFile},
+		{Action: actionStart, Template: "bad", Instance: "badInt(int)", File: path.Join(output, "gotemplate_badInt.go")},
+	}
+	if len(events) != len(expected)+2 {
+		t.Fatalf("Expecting %d events but got %d: %+v", len(expected)+2, len(events), events)
+	}
+	for i, e := range expected {
+		if events[i] != e {
+			t.Errorf("Event %d: got %+v expecting %+v", i, events[i], e)
+		}
+	}
+
+	// Each type checking error is reported with its position
+	for i, line := range []int{6, 8} {
+		e := events[len(expected)+i]
+		if e.Action != actionDiagnostic || e.Severity != severityError || e.Code != "typecheck" ||
+			path.Base(e.File) != "main.go" || e.Line != line || e.Column == 0 || e.Message == "" ||
+			e.Template != "bad" || e.Instance != "badInt(int)" {
+			t.Errorf("Bad diagnostic for line %d: %+v", line, e)
+		}
+	}
+}
+
+func TestTypeCheckErrors(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Pair(A, B)
+type A int
+type B int
+
+// template if comparable(A)
+func x() {}
+// template end
+
+// template if comparable(B)
+func y() {}
+// template end
+`, map[string]string{
+		"bad/main.go":   "package bad\n\n// template type Bad(A)\ntype A int\n\nvar x int = \"a\"\n\nfunc f() {\n\tundefined()\n}\n",
+		"plain/main.go": "package plain\n\n// template type Pair(A, B)\ntype A int\ntype B int\n\ntype Pair struct {\n\ta A\n\tb B\n}\n",
+		"tuple/main.go": "package tuple\n\n// template type Tuple(A...)\ntype A int\n\ntype Tuple struct {\n\t// template repeat\n\tF A\n}\n",
+	})
+	defer cleanup()
+
+	// Every error in the template is reported with its source
+	err := catchFatal(func() {
+		newTemplate(output, "bad", "badInt(int)").instantiate()
+	})
+	if err == nil {
+		t.Fatalf("Expecting type checking error")
+	}
+	for _, want := range []string{
+		`found 2 errors in template "bad" itself`,
+		"main.go:6:13: cannot use \"a\"",
+		"\n\tvar x int = \"a\"\n\t            ^",
+		"main.go:9:2: undefined: undefined",
+		"\n\t\tundefined()\n\t\t^",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expecting %q in %q", want, err.Error())
+		}
+	}
+
+	// Every bad argument is reported and told apart from the template
+	err = catchFatal(func() {
+		newTemplate(output, "input", "myPair(Unknown, 1)").instantiate()
+	})
+	if err == nil {
+		t.Fatalf("Expecting argument error")
+	}
+	ds := errorDiagnostics(err)
+	if len(ds) != 2 {
+		t.Fatalf("Expecting 2 diagnostics but got %d: %v", len(ds), err)
+	}
+	for i, want := range []string{
+		`Failed to type check argument "Unknown" for A`,
+		`Argument "1" for B is not a type`,
+	} {
+		if ds[i].Code != "argument" || !strings.HasPrefix(ds[i].Message, want) {
+			t.Errorf("Diagnostic %d: got %+v expecting %q", i, ds[i], want)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "Found 2 errors in the arguments of myPair(Unknown, 1)") {
+		t.Errorf("Bad error %q", err)
+	}
+
+	// The arguments are checked even if no condition uses them
+	for _, test := range []struct {
+		pkg, spec string
+		errors    int
+	}{
+		{"plain", "MySet(nosuch, alsoMissing)", 2},
+		{"tuple", "Triple(int, nosuch, []alsoMissing)", 2},
+	} {
+		err = catchFatal(func() {
+			newTemplate(output, test.pkg, test.spec).instantiate()
+		})
+		if err == nil {
+			t.Fatalf("%s: expecting argument error", test.spec)
+		}
+		if ds := errorDiagnostics(err); len(ds) != test.errors {
+			t.Errorf("%s: expecting %d diagnostics but got %d: %v", test.spec, test.errors, len(ds), err)
+		}
+		name := test.spec[:strings.Index(test.spec, "(")]
+		if _, err := os.Stat(path.Join(output, "gotemplate_"+name+".go")); err == nil {
+			t.Errorf("%s: instance written", test.spec)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Adder(A)
+type A int
+
+type Adder []A
+
+// Sum adds up the elements
+func (a Adder) Sum() (total A) {
+	for _, x := range a {
+		total += x
+	}
+	return total
+}
+`, nil)
+	defer cleanup()
+	var logged []string
+	logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	defer func() { logf = log.Printf }()
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	instantiate := func(spec string, force bool) error {
+		return catchFatal(func() {
+			// Checking is the default
+			o := newOptions(flag.NewFlagSet("test", flag.ContinueOnError))
+			o.force, o.cache = force, true
+			tt := newTemplate(output, "input", spec)
+			o.apply(tt)
+			tt.instantiate()
+		})
+	}
+	exists := func(fileName string) bool {
+		_, err := os.Stat(path.Join(output, fileName))
+		return err == nil
+	}
+
+	if err := instantiate("intAdder(int)", false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !exists("gotemplate_intAdder.go") {
+		t.Errorf("Instance which type checks wasn't written")
+	}
+
+	// The error is reported with the template line responsible
+	err := instantiate("boolAdder(bool)", false)
+	if err == nil {
+		t.Fatalf("Expecting type checking error")
+	}
+	ds := errorDiagnostics(err)
+	if len(ds) != 1 || ds[0].Code != "check" || path.Base(ds[0].File) != "gotemplate_boolAdder.go" ||
+		!strings.HasSuffix(ds[0].Message, "input/main.go:11)") || !strings.Contains(ds[0].Context, "total += x") {
+		t.Errorf("Bad diagnostics %+v", ds)
+	}
+	if !strings.Contains(err.Error(), "use -force") {
+		t.Errorf("Bad error %q", err)
+	}
+	if exists("gotemplate_boolAdder.go") {
+		t.Errorf("Instance which doesn't type check was written")
+	}
+
+	// Unless it is forced
+	if err := instantiate("boolAdder(bool)", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !exists("gotemplate_boolAdder.go") {
+		t.Errorf("Forced instance wasn't written")
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "with 1 errors because of -force") {
+		t.Errorf("Bad log %q", logged)
+	}
+
+	// The cached instance is checked too
+	if err := os.Remove(path.Join(output, "gotemplate_boolAdder.go")); err != nil {
+		t.Fatalf("Failed to remove instance: %v", err)
+	}
+	if err := instantiate("boolAdder(bool)", false); err == nil || !strings.Contains(err.Error(), "use -force") {
+		t.Errorf("Cached instance not type checked: %v", err)
+	}
+	if exists("gotemplate_boolAdder.go") {
+		t.Errorf("Cached instance which doesn't type check was written")
+	}
+}
+
+func TestCheckSharedAndRepeats(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Summer(A)
+type A int
+
+func Summer(a []A) (total A) {
+	for _, x := range a {
+		total += x
+	}
+	return total
+}
+
+func Count(a []A) int { return twice(len(a)) }
+
+func twice(n int) int { return 2 * n }
+`, map[string]string{
+		"variadic/main.go": `package tt
+
+// template type Adders(A...)
+type A int
+
+type Adders struct{}
+
+// template repeat
+func AddA(x, y A) A { return x + y }
+`,
+	})
+	defer cleanup()
+	instantiate := func(pkg, spec string) error {
+		return catchFatal(func() {
+			tt := newTemplate(output, pkg, spec)
+			tt.typeCheck, tt.shareHelpers = true, true
+			tt.instantiate()
+		})
+	}
+	sharedFile := path.Join(output, "gotemplate_shared_Summer.go")
+
+	// The instance is checked with the helpers it shares
+	if err := instantiate("input", "intSummer(int)"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shared, err := ioutil.ReadFile(sharedFile)
+	if err != nil {
+		t.Fatalf("Shared file not written: %v", err)
+	}
+
+	// and the shared file isn't changed if the check fails
+	if err := instantiate("input", "boolSummer(bool)"); err == nil {
+		t.Fatalf("Expecting type checking error")
+	}
+	if newShared, _ := ioutil.ReadFile(sharedFile); !bytes.Equal(newShared, shared) {
+		t.Errorf("Shared file changed by instance which doesn't type check:\n%s", newShared)
+	}
+
+	// Repeated declarations are mapped onto the template
+	if err := instantiate("variadic", "Numbers(int, float64)"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := instantiate("variadic", "Mixed(int, bool)"); err == nil || !strings.Contains(err.Error(), "variadic/main.go:9)") {
+		t.Errorf("Expecting error from line 9 of the template but got %v", err)
+	}
+}
+
+func TestTemplateTests(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Bag(A)
+type A int
+
+type Bag []A
+
+func (b *Bag) Add(a A) { *b = append(*b, a) }
+
+func (b Bag) Count(a A) (n int) {
+	for _, x := range b {
+		if x == a {
+			n++
+		}
+	}
+	return n
+}
+`, map[string]string{
+		"input/main_test.go": `package tt
+
+import "testing"
+
+// newA makes a test value
+//
+// template generator A
+func newA(i int) A { return A(i) }
+
+func helper(t *testing.T, b Bag, i, want int) {
+	if got := b.Count(newA(i)); got != want {
+		t.Errorf("Count(%v) = %d, want %d", newA(i), got, want)
+	}
+}
+
+func TestCount(t *testing.T) {
+	var b Bag
+	b.Add(newA(1))
+	b.Add(newA(2))
+	b.Add(newA(1))
+	helper(t, b, 1, 2)
+	helper(t, b, 2, 1)
+	helper(t, b, 3, 0)
+}
+`,
+		"output/point.go": `package main
+
+type point struct{ x, y int }
+
+func newPoint(i int) point { return point{i, -i} }
+
+func helper() {}
+`,
+	})
+	defer cleanup()
+	var out bytes.Buffer
+	goTestOutput = &out
+	defer func() { goTestOutput = os.Stdout }()
+	o := newOptions(flag.NewFlagSet("test", flag.ContinueOnError))
+
+	if err := catchFatal(func() {
+		runTemplateTests(output, "input", "intBag(int)", o, nil, []string{"-v"})
+	}); err != nil {
+		t.Fatalf("Tests failed: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "--- PASS: TestCount") {
+		t.Errorf("Tests didn't run: %s", out.String())
+	}
+
+	// The template's generator doesn't work for point
+	out.Reset()
+	err := catchFatal(func() {
+		runTemplateTests(output, "input", "pointBag(point)", o, nil, nil)
+	})
+	if err == nil || !strings.Contains(out.String(), "cannot convert") {
+		t.Errorf("Expecting tests to fail to build but got %v\n%s", err, out.String())
+	}
+
+	// But one from the package does
+	out.Reset()
+	if err := catchFatal(func() {
+		runTemplateTests(output, "input", "pointBag(point)", o, map[string]string{"newA": "newPoint"}, nil)
+	}); err != nil {
+		t.Fatalf("Tests failed: %v\n%s", err, out.String())
+	}
+
+	err = catchFatal(func() {
+		runTemplateTests(output, "input", "pointBag(point)", o, map[string]string{"newB": "newPoint"}, nil)
+	})
+	if err == nil || !strings.Contains(err.Error(), "newB") {
+		t.Errorf("Expecting unknown generator error but got %v", err)
+	}
+
+	// The test directories are removed
+	matches, _ := filepath.Glob(filepath.Join(output, "_gotemplate_test*"))
+	if len(matches) != 0 {
+		t.Errorf("Test directories left behind: %q", matches)
+	}
+}
+
+// Run the treemap tests on a map with a key which isn't an int
+func TestTemplateTestsTreeMap(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	files := map[string]string{
+		"output/point.go": `package main
+
+type point struct{ x, y int }
+
+func newPoint(i int) point { return point{i, -i} }
+
+func pointLess(a, b point) bool { return a.x < b.x }
+`,
+	}
+	fileNames, err := filepath.Glob(filepath.Join("..", "..", "treemap", "*.go"))
+	if err != nil || len(fileNames) == 0 {
+		t.Fatalf("Failed to find the treemap files: %v", err)
+	}
+	for _, fileName := range fileNames {
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("Failed to read %q: %v", fileName, err)
+		}
+		files["github.com/ncw/gotemplate/treemap/"+filepath.Base(fileName)] = string(b)
+	}
+	output, cleanup := setupTest(t, "package input\n", files)
+	defer cleanup()
+	var out bytes.Buffer
+	goTestOutput = &out
+	defer func() { goTestOutput = os.Stdout }()
+	var logged []string
+	logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	defer func() { logf = log.Printf }()
+	o := newOptions(flag.NewFlagSet("test", flag.ContinueOnError))
+
+	if err := catchFatal(func() {
+		runTemplateTests(output, "github.com/ncw/gotemplate/treemap", "pointMap(point, string)", o, map[string]string{"newKey": "newPoint", "less": "pointLess"}, []string{"-v", "-run", "Test"})
+	}); err != nil {
+		t.Fatalf("Tests failed: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"--- PASS: TestRandom", "--- PASS: TestLowerBound"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Test didn't run %q: %s", want, out.String())
+		}
+	}
+
+	// The examples are in an external test package so are reported
+	if got := strings.Join(logged, "\n"); !strings.Contains(got, "treemap_test: examples_test.go") {
+		t.Errorf("External tests not reported: %q", got)
+	}
+}
+
+func TestTestOutput(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+// template type Box(A)
+type A int
+
+type Box struct{ a A }
+
+func (b Box) Get() A { return b.a }
+`, map[string]string{
+		"output/main_test.go": "package main_test\n\n//go:generate gotemplate input extBox(string)\n",
+		"only/only_test.go":   "package only_test\n",
+	})
+	defer cleanup()
+
+	readPackage := func(fileName string) string {
+		_, f := parseFile(path.Join(output, fileName), nil)
+		return f.Name.Name
+	}
+
+	// -test outside go generate uses the external test package
+	// when there are only external tests
+	tt := newTemplate(output, "input", "cliBox(string)")
+	tt.testOutput = true
+	tt.generatedFrom("", "")
+	if tt.NewPackage != "main_test" {
+		t.Errorf("Bad package %q", tt.NewPackage)
+	}
+
+	// otherwise -test writes a test file in the package
+	tt = newTemplate(output, "input", "intBox(int)")
+	tt.testOutput = true
+	tt.instantiate()
+	if got := readPackage("gotemplate_intBox_test.go"); got != "main" {
+		t.Errorf("Bad package %q", got)
+	}
+	if got := findTestPackageName(output); got != "main" {
+		t.Errorf("Bad test package name %q", got)
+	}
+
+	// as does a directive in a test file, using its package which
+	// is type checked with the tests
+	tt = newTemplate(output, "input", "extBox(string)")
+	tt.generatedFrom(path.Join(output, "main_test.go"), "main_test")
+	tt.typeCheck = true
+	tt.instantiate()
+	if got := readPackage("gotemplate_extBox_test.go"); got != "main_test" {
+		t.Errorf("Bad package %q", got)
+	}
+	if _, err := os.Stat(path.Join(output, "gotemplate_extBox.go")); err == nil {
+		t.Errorf("Instance written to non test file")
+	}
+
+	// Without $GOPACKAGE the package is read from the file
+	tt = newTemplate(output, "input", "envBox(string)")
+	tt.generatedFrom("main_test.go", "")
+	if tt.NewPackage != "main_test" || tt.outputFileName() != "gotemplate_envBox_test.go" {
+		t.Errorf("Bad package %q for %q", tt.NewPackage, tt.outputFileName())
+	}
+
+	// Directives in other files don't
+	tt = newTemplate(output, "input", "strBox(string)")
+	tt.generatedFrom(path.Join(output, "main.go"), "main")
+	if name := tt.outputFileName(); name != "gotemplate_strBox.go" {
+		t.Errorf("Bad output file %q", name)
+	}
+
+	// The package name is found from test files
+	if got := findPackageName(path.Join(path.Dir(output), "only")); got != "only" {
+		t.Errorf("Bad package name %q", got)
+	}
+	if got := findTestPackageName(path.Join(path.Dir(output), "only")); got != "only_test" {
+		t.Errorf("Bad test package name %q", got)
+	}
+
+	// The helpers aren't shared with the other instances
+	tt = newTemplate(output, "input", "sharedBox(int)")
+	tt.testOutput, tt.shareHelpers = true, true
+	tt.instantiate()
+	if tt.shareHelpers {
+		t.Errorf("Helpers shared by test instance")
+	}
+}
+
+func TestBundle(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, `package tt
+
+import "strings"
+
+// template type Box(A)
+type A int
+
+type Box struct{ a A }
+
+func (b Box) Name() string { return strings.ToUpper("box") }
+`, map[string]string{
+		"other/main.go": `package other
+
+import "strconv"
+
+// template type Thing(A)
+type A int
+
+type Thing struct{ a A }
+
+func (t Thing) Name() string { return strconv.Itoa(1) }
+`,
+		"output/gotemplate.json": `{"instances": [
+	{"template": "input", "instance": "aBox(int8)", "bundle": "config"},
+	{"template": "other", "instance": "bThing(int8)", "bundle": "config"}
+]}`,
+	})
+	defer cleanup()
+	directives := path.Join(output, "sets.go")
+	writeDirectives := func(specs ...string) {
+		src := "package main\n\n"
+		for _, spec := range specs {
+			src += "//go:generate gotemplate -bundle " + spec + "\n"
+		}
+		if err := ioutil.WriteFile(directives, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	instantiate := func(pkg, spec string) *template {
+		tt := newTemplate(output, pkg, spec)
+		tt.bundle = true
+		tt.generatedFrom("sets.go", "main")
+		tt.instantiate()
+		return tt
+	}
+	writeDirectives("input intBox(int)", "input strBox(string)", "other intThing(int)")
+
+	// The instances are merged in order of name with one header
+	// and merged imports whichever order they are generated in
+	expected := `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+//gotemplate:instance intBox
+
+// template type Box(A)
+
+type intBox struct{ a int }
+
+func (b intBox) Name() string { return strings.ToUpper("box") }
+
+//gotemplate:instance intThing
+
+// template type Thing(A)
+
+type intThing struct{ a int }
+
+func (t intThing) Name() string { return strconv.Itoa(1) }
+
+//gotemplate:instance strBox
+
+// template type Box(A)
+
+type strBox struct{ a string }
+
+func (b strBox) Name() string { return strings.ToUpper("box") }
+`
+	for _, order := range [][]string{{"intBox", "strBox", "intThing"}, {"intThing", "strBox", "intBox"}} {
+		_ = os.Remove(path.Join(output, "gotemplate_sets.go"))
+		for _, name := range order {
+			switch name {
+			case "intBox":
+				instantiate("input", "intBox(int)")
+			case "strBox":
+				instantiate("input", "strBox(string)")
+			case "intThing":
+				instantiate("other", "intThing(int)")
+			}
+		}
+		checkOutput(t, output, "gotemplate_sets.go", expected)
+	}
+
+	// The bundle is up to date for each instance
+	tt := newTemplate(output, "input", "strBox(string)")
+	tt.bundle = true
+	tt.generatedFrom("sets.go", "main")
+	tt.checkInstance()
+
+	// Instances whose directives have gone are dropped
+	writeDirectives("input strBox(string)")
+	instantiate("input", "strBox(string)")
+	checkOutput(t, output, "gotemplate_sets.go", `// Code generated by gotemplate. DO NOT EDIT.
+
+package main
+
+import "strings"
+
+//gotemplate:instance strBox
+
+// template type Box(A)
+
+type strBox struct{ a string }
+
+func (b strBox) Name() string { return strings.ToUpper("box") }
+`)
+
+	// Bundles from a config file
+	generate(output, "", opts, 2)
+	src, err := ioutil.ReadFile(path.Join(output, "gotemplate_config.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), "type aBox struct{ a int8 }") || !strings.Contains(string(src), "type bThing struct{ a int8 }") {
+		t.Errorf("Bad config bundle:\n%s", src)
+	}
+
+	// which need $GOFILE otherwise
+	err = catchFatal(func() {
+		tt := newTemplate(output, "input", "intBox(int)")
+		tt.bundle = true
+		tt.instantiate()
+	})
+	if err == nil || !strings.Contains(err.Error(), "GOFILE") {
+		t.Errorf("Expecting error about $GOFILE but got %v", err)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		file   string
+		line   int
+		column int
+	}{
+		{"", "", 0, 0},
+		{"-", "", 0, 0},
+		{"a/b.go", "a/b.go", 0, 0},
+		{"a/b.go:12", "a/b.go", 12, 0},
+		{"a/b.go:12:5", "a/b.go", 12, 5},
+		{`C:\a\b.go:12:5`, `C:\a\b.go`, 12, 5},
+	} {
+		pos := parsePosition(test.in)
+		if pos.Filename != test.file || pos.Line != test.line || pos.Column != test.column {
+			t.Errorf("%q: got %v expecting %s %d %d", test.in, pos, test.file, test.line, test.column)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fatalf = func(format string, args ...interface{}) {
+		t.Fatalf(format, args...)
+	}
+	output, cleanup := setupTest(t, namingTest, map[string]string{
+		"output/gen.go": "package main\n\n//go:generate gotemplate -naming prefix \"input\" \"mySet(int)\"\n",
+	})
+	defer cleanup()
+	templateFile := path.Join(path.Dir(output), "input", "main.go")
+	outputFile := path.Join(output, "gotemplate_mySet.go")
+	modTime := time.Now()
+	write := func(fileName, contents string) {
+		err := ioutil.WriteFile(fileName, []byte(contents), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %q: %v", fileName, err)
+		}
+		// Make sure the change is noticed even if the clock is coarse
+		modTime = modTime.Add(time.Second)
+		err = os.Chtimes(fileName, modTime, modTime)
+		if err != nil {
+			t.Fatalf("Failed to set time of %q: %v", fileName, err)
+		}
+	}
+
+	w := newWatcher(output, []string{"./..."})
+	if len(w.instances) != 1 {
+		t.Fatalf("Expecting 1 instance but got %d", len(w.instances))
+	}
+	if errs := w.poll(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Fatalf("Generated output without a change: %v", err)
+	}
+
+	// Changing the template regenerates the instance
+	write(templateFile, namingTest+"\nfunc Another() {}\n")
+	if errs := w.poll(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	data, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Instance not generated: %v", err)
+	}
+	if !strings.Contains(string(data), "func mySetAnother() {}") {
+		t.Errorf("Instance wrong: %s", data)
+	}
+
+	// Errors are reported without stopping
+	write(templateFile, namingTest+"\nfunc Another() {\n")
+	if errs := w.poll(); len(errs) != 1 {
+		t.Fatalf("Expecting 1 error but got %v", errs)
+	}
+
+	// Changing the directive regenerates it too
+	write(templateFile, namingTest)
+	write(path.Join(output, "gen.go"), "package main\n\n//go:generate gotemplate \"input\" \"yourSet(int)\"\n")
+	if errs := w.poll(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if _, err := os.Stat(path.Join(output, "gotemplate_yourSet.go")); err != nil {
+		t.Errorf("New instance not generated: %v", err)
+	}
+}
+
+func TestParseDirectiveFlags(t *testing.T) {
+	o, rest, err := parseDirectiveFlags([]string{"-v", "-j", "4", "-json", "-poll", "2s", "-generator", "newA=newB", "-naming", "prefix", "input", "mySet(int)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.naming != namingPrefix {
+		t.Errorf("Wrong naming %q", o.naming)
+	}
+	if strings.Join(rest, "|") != "input|mySet(int)" {
+		t.Errorf("Wrong arguments %q", rest)
+	}
+	if _, _, err := parseDirectiveFlags([]string{"-unknown", "input", "mySet(int)"}); err == nil {
+		t.Errorf("Expecting error for unknown flag")
+	}
+}
+
+func TestSplitGenerateLine(t *testing.T) {
+	expand := func(name string) string { return "<" + name + ">" }
+	words, err := splitGenerateLine(`gotemplate  -shared "pkg/$GOFILE" "Set(func(a, b string) bool { return a > \"b\" })"`, expand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"gotemplate", "-shared", "pkg/<GOFILE>", `Set(func(a, b string) bool { return a > "b" })`}
+	if strings.Join(words, "|") != strings.Join(expected, "|") {
+		t.Errorf("Got %q expected %q", words, expected)
+	}
+	if _, err := splitGenerateLine(`gotemplate "unterminated`, expand); err == nil {
+		t.Errorf("Expecting error for unterminated string")
+	}
+}
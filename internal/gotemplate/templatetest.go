@@ -0,0 +1,244 @@
+// Running the template's own tests against an instance
+
+package gotemplate
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+// "template generator A" on a function in a test file which makes
+// test values for the parameter A
+var matchTemplateGenerator = regexp.MustCompile(`^//\s*template\s+generator\s+(\w+)\s*$`)
+
+// Where the output of go test is written
+var goTestOutput io.Writer = os.Stdout
+
+// Prefixes of the functions go test runs which keep their names
+var testFuncPrefixes = []string{"Test", "Benchmark", "Example", "Fuzz"}
+
+// loadTemplateTests loads the template package in inputFile with its
+// test files, returning all the packages loaded and the one with the
+// template and its internal tests in
+func loadTemplateTests(conf *packages.Config, inputFile string) ([]*packages.Package, *packages.Package) {
+	conf.Tests = true
+	conf.Dir = filepath.Dir(inputFile)
+	pkgs, err := loadPackages(conf, ".")
+	if err != nil {
+		fatalf("Type checking error: %v", err)
+	}
+	var testPkg *packages.Package
+	for _, pkg := range pkgs {
+		if !strings.HasSuffix(pkg.ID, ".test]") {
+			continue
+		}
+		if strings.HasSuffix(pkg.Name, "_test") {
+			// The external tests use the template through its
+			// import path so can't be run against the instance
+			logf("Not running the tests in the external test package %s: %s", pkg.Name, strings.Join(baseNames(pkg.GoFiles), ", "))
+			continue
+		}
+		for _, fileName := range pkg.CompiledGoFiles {
+			if fileName == inputFile {
+				testPkg = pkg
+			}
+		}
+	}
+	if testPkg != nil {
+		return pkgs, testPkg
+	}
+	fatalf("Didn't find any tests for %s in %s", filepath.Base(inputFile), conf.Dir)
+	return nil, nil
+}
+
+// baseNames returns the file names in paths without their directories
+func baseNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+// isTestFunc returns whether name is run by go test, eg TestX but
+// not Testx
+func isTestFunc(name string) bool {
+	for _, prefix := range testFuncPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			rest := name[len(prefix):]
+			if rest == "" || rest == "_" || !unicode.IsLower(rune(rest[0])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generatorParam returns the template parameter the function is a
+// "template generator" for or ""
+func generatorParam(d *ast.FuncDecl) string {
+	if d.Doc == nil {
+		return ""
+	}
+	for _, c := range d.Doc.List {
+		if matches := matchTemplateGenerator.FindStringSubmatch(c.Text); matches != nil {
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+// mangleTestDecls works out the names of the top level identifiers
+// in the test files
+//
+// The functions go test runs keep their names and the generators
+// named with -generator are replaced.
+func (t *template) mangleTestDecls(info *types.Info) {
+	found := map[string]bool{}
+	for _, f := range t.testSyntax {
+		var newDecls []ast.Decl
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok == token.IMPORT {
+					break
+				}
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						t.addMapping(info.Defs[s.Name], s.Name.Name)
+					case *ast.ValueSpec:
+						for _, name := range s.Names {
+							if name.Name != "_" {
+								t.addMapping(info.Defs[name], name.Name)
+							}
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv != nil || d.Name.Name == "init" || isTestFunc(d.Name.Name) {
+					break
+				}
+				if param := generatorParam(d); param != "" {
+					if _, ok := t.templateArgsMap[param]; !ok {
+						fatalf("%s: \"template generator\" for unknown parameter %q", t.testFset.Position(d.Pos()), param)
+					}
+					if generator, ok := t.generators[d.Name.Name]; ok {
+						debugf("Using generator %s for %s instead of %s", generator, param, d.Name.Name)
+						found[d.Name.Name] = true
+						t.mappings[info.Defs[d.Name]] = generator
+						from := d.Pos()
+						if d.Doc != nil {
+							from = d.Doc.Pos()
+						}
+						removeComments(f, from, d.End())
+						continue
+					}
+				}
+				t.addMapping(info.Defs[d.Name], d.Name.Name)
+			}
+			newDecls = append(newDecls, decl)
+		}
+		f.Decls = newDecls
+	}
+	for name := range t.generators {
+		if !found[name] {
+			fatalf("Didn't find a \"template generator\" called %s in the tests", name)
+		}
+	}
+}
+
+// testFileName returns the name the instance of the test file
+// fileName is written to
+func (t *template) testFileName(fileName string) string {
+	return strings.TrimSuffix(t.outputFileName(), ".go") + "_" + filepath.Base(fileName)
+}
+
+// writeTestFiles writes the instances of the test files
+func (t *template) writeTestFiles() {
+	for _, f := range t.testSyntax {
+		fileName := filepath.Join(t.Dir, t.testFileName(t.testFset.File(f.Pos()).Name()))
+		f.Name.Name = t.NewPackage
+		var b bytes.Buffer
+		if err := format.Node(&b, t.testFset, f); err != nil {
+			fatalf("Failed to format test file: %v", err)
+		}
+		src, err := imports.Process(fileName, b.Bytes(), nil)
+		if err != nil {
+			fatalf("Cannot fix imports in test file: %v", err)
+		}
+		writeFile(fileName, append([]byte(genHeader), src...))
+	}
+}
+
+// copyPackage copies the files of the package in dir to the empty
+// directory newDir, leaving out the tests
+func copyPackage(dir, newDir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fatalf("Failed to read %q: %v", dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fatalf("Failed to read %q: %v", entry.Name(), err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(newDir, entry.Name()), b, 0666); err != nil {
+			fatalf("Failed to copy %q: %v", entry.Name(), err)
+		}
+	}
+}
+
+// runTemplateTests instantiates the template and its tests into a
+// copy of the package in dir then runs go test with goTestArgs on it
+//
+// The copy is made in a temporary directory in dir so the arguments
+// can use anything in the package.
+func runTemplateTests(dir, pkg, spec string, o *options, generators map[string]string, goTestArgs []string) {
+	testDir, err := ioutil.TempDir(dir, "_gotemplate_test")
+	if err != nil {
+		fatalf("Failed to make test directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(testDir); err != nil {
+			logf("Failed to remove %q: %v", testDir, err)
+		}
+	}()
+	copyPackage(dir, testDir)
+
+	t := newTemplateInPackage(testDir, pkg, spec, findPackageName(dir))
+	o.apply(t)
+	t.withTests = true
+	t.generators = generators
+	// The instances of the tests aren't cached
+	t.cache = false
+	t.instantiate()
+
+	cmd := exec.Command("go", append([]string{"test"}, goTestArgs...)...)
+	cmd.Dir = testDir
+	cmd.Stdout, cmd.Stderr = goTestOutput, goTestOutput
+	if *jsonOutput && goTestOutput == os.Stdout {
+		// Keep stdout for the events
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	}
+	if err := cmd.Run(); err != nil {
+		fatalf("Tests of %s failed: %v", t.spec(), err)
+	}
+}
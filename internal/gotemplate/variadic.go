@@ -0,0 +1,356 @@
+// Expands the repeated parts of templates with variadic parameters
+
+package gotemplate
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// "template repeat"
+var matchTemplateRepeat = regexp.MustCompile(`^//\s*template\s+repeat\s*$`)
+
+// Placeholders left in the source of repeated elements which are
+// replaced by the argument and its index in each copy
+const (
+	repeatArg       = "__gotemplate_arg__"
+	repeatName      = "__gotemplate_name__"
+	repeatLowerName = "__gotemplate_lower_name__"
+	repeatIndex     = "__gotemplate_index__"
+)
+
+// definedIdents returns the identifiers the repeated element n
+// declares itself
+func definedIdents(n ast.Node) []*ast.Ident {
+	switch n := n.(type) {
+	case *ast.Field:
+		return n.Names
+	case *ast.ValueSpec:
+		return n.Names
+	case *ast.TypeSpec:
+		return []*ast.Ident{n.Name}
+	case *ast.FuncDecl:
+		return []*ast.Ident{n.Name}
+	case *ast.GenDecl:
+		var idents []*ast.Ident
+		for _, spec := range n.Specs {
+			idents = append(idents, definedIdents(spec)...)
+		}
+		return idents
+	}
+	return nil
+}
+
+// listElements returns the elements of n if it is one of the lists
+// whose elements can be repeated
+func listElements(n ast.Node) []ast.Node {
+	var elements []ast.Node
+	switch n := n.(type) {
+	case *ast.File:
+		for _, decl := range n.Decls {
+			elements = append(elements, decl)
+		}
+	case *ast.GenDecl:
+		for _, spec := range n.Specs {
+			elements = append(elements, spec)
+		}
+	case *ast.FieldList:
+		for _, field := range n.List {
+			elements = append(elements, field)
+		}
+	case *ast.BlockStmt:
+		for _, stmt := range n.List {
+			elements = append(elements, stmt)
+		}
+	case *ast.CaseClause:
+		for _, stmt := range n.Body {
+			elements = append(elements, stmt)
+		}
+	case *ast.CommClause:
+		for _, stmt := range n.Body {
+			elements = append(elements, stmt)
+		}
+	case *ast.CompositeLit:
+		for _, elt := range n.Elts {
+			elements = append(elements, elt)
+		}
+	}
+	return elements
+}
+
+// A "template repeat" directive and the element it repeats
+type repeat struct {
+	directive *ast.Comment
+	element   ast.Node
+	commas    bool // set if the elements of the list are separated by commas
+}
+
+// findRepeats returns the "template repeat" comments in f along with
+// the elements of lists on the lines after them
+func findRepeats(fset *token.FileSet, f *ast.File) (repeats []repeat) {
+	elementLines := map[int]*ast.Comment{}
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if matchTemplateRepeat.MatchString(c.Text) {
+				elementLines[fset.Position(cg.End()).Line+1] = c
+			}
+		}
+	}
+	if len(elementLines) == 0 {
+		return nil
+	}
+	found := map[*ast.Comment]repeat{}
+	commaLists := map[*ast.FieldList]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		commas := false
+		switch n := n.(type) {
+		case *ast.FuncType:
+			// Parameters and results are separated by commas
+			// but struct fields and interface methods aren't
+			commaLists[n.Params] = true
+			if n.Results != nil && n.Results.Opening.IsValid() {
+				commaLists[n.Results] = true
+			}
+		case *ast.FieldList:
+			commas = commaLists[n]
+		case *ast.CompositeLit:
+			commas = true
+		}
+		for _, element := range listElements(n) {
+			// The first element on the line is the one repeated
+			c := elementLines[fset.Position(element.Pos()).Line]
+			if _, ok := found[c]; c != nil && !ok {
+				found[c] = repeat{directive: c, element: element, commas: commas}
+			}
+		}
+		return true
+	})
+	for _, c := range elementLines {
+		r, ok := found[c]
+		if !ok {
+			fatalf("%s: Didn't find anything to repeat after \"template repeat\"", fset.Position(c.Pos()))
+		}
+		repeats = append(repeats, r)
+	}
+	sort.Slice(repeats, func(i, j int) bool { return repeats[i].directive.Pos() < repeats[j].directive.Pos() })
+	for i := 1; i < len(repeats); i++ {
+		if repeats[i].directive.Pos() < repeats[i-1].element.End() {
+			fatalf("%s: \"template repeat\" can't be nested", fset.Position(repeats[i].directive.Pos()))
+		}
+	}
+	return repeats
+}
+
+// replaceWord replaces the first occurrence of word in name with
+// replacement if it is a whole word in camel case
+func replaceWord(name, word, replacement string) (string, bool) {
+	for i := 0; i+len(word) <= len(name); i++ {
+		if !strings.HasPrefix(name[i:], word) {
+			continue
+		}
+		end := i + len(word)
+		if end < len(name) && unicode.IsLower(rune(name[end])) {
+			continue
+		}
+		return name[:i] + replacement + name[end:], true
+	}
+	return name, false
+}
+
+// markRepeats renames the identifiers in the elements marked with a
+// "template repeat" comment so expandRepeats can make a copy of each
+// for each of the variadic arguments.
+//
+// In the i-th copy the variadic parameter becomes the i-th argument,
+// a name declared by the element which contains the variadic
+// parameter's name as a word has it replaced by the name made from the
+// i-th argument by argName, and any other name declared by it has i
+// appended. Uses of names declared by repeated elements are renamed
+// to match.
+func (t *template) markRepeats(fset *token.FileSet, f *ast.File, info *types.Info) {
+	repeats := findRepeats(fset, f)
+	if len(repeats) == 0 {
+		if t.variadic {
+			fatalf("Template has variadic parameter %q but no \"template repeat\"", t.variadicParam)
+		}
+		return
+	}
+	if !t.variadic {
+		fatalf("Found \"template repeat\" but template has no variadic parameter")
+	}
+
+	// Find the objects the repeated elements declare
+	repeatedObjs := map[types.Object]bool{}
+	for _, r := range repeats {
+		for _, id := range definedIdents(r.element) {
+			repeatedObjs[info.Defs[id]] = true
+		}
+	}
+
+	inRepeat := func(pos token.Pos) bool {
+		for _, r := range repeats {
+			if pos >= r.element.Pos() && pos < r.element.End() {
+				return true
+			}
+		}
+		return false
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := info.Defs[id]
+		if obj == nil {
+			obj = info.Uses[id]
+		}
+		if obj == nil || (obj != t.variadicObj && !repeatedObjs[obj]) {
+			return true
+		}
+		if !inRepeat(id.Pos()) {
+			fatalf("%s: %q can only be used inside a \"template repeat\"", fset.Position(id.Pos()), id.Name)
+		}
+		if obj == t.variadicObj {
+			id.Name = repeatArg
+		} else if name, ok := replaceWord(id.Name, t.variadicParam, repeatName); ok {
+			if strings.HasPrefix(name, repeatName) && !ast.IsExported(t.variadicParam) {
+				name = repeatLowerName + name[len(repeatName):]
+			}
+			id.Name = name
+		} else {
+			id.Name += repeatIndex
+		}
+		return true
+	})
+}
+
+// argName returns the word which replaces the variadic parameter's
+// name in the names declared by the i-th copy of a repeated element.
+//
+// This is arg capitalized if it is an identifier, eg IsA becomes
+// IsInt, otherwise the parameter's name with i appended, eg IsA0 for
+// []byte.  At the start of a name the parameter's case is kept.
+func (t *template) argName(i int, arg string, start bool) string {
+	if !token.IsIdentifier(arg) {
+		return t.variadicParam + strconv.Itoa(i)
+	}
+	return setExported(arg, !start || ast.IsExported(t.variadicParam))
+}
+
+// hasRepeatPlaceholder returns whether markRepeats left any
+// placeholders in name
+func hasRepeatPlaceholder(name string) bool {
+	for _, placeholder := range []string{repeatArg, repeatName, repeatLowerName, repeatIndex} {
+		if strings.Contains(name, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatReplacer returns the replacer for the placeholders left by
+// markRepeats in the i-th copy of a repeated element
+func (t *template) repeatReplacer(i int, arg string) *strings.Replacer {
+	return strings.NewReplacer(
+		repeatArg, arg,
+		repeatName, t.argName(i, arg, false),
+		repeatLowerName, t.argName(i, arg, true),
+		repeatIndex, strconv.Itoa(i),
+	)
+}
+
+// expandDeclPositions returns the template positions of the top
+// level declarations in src, the instance before expandRepeats, once
+// the repeated declarations are copied
+//
+// positions are those of the declarations in src, each copy of a
+// repeated declaration getting the position of the one it was copied
+// from.
+func (t *template) expandDeclPositions(fileName string, src []byte, positions []token.Position) []token.Position {
+	fset, f := parseFile(fileName, src)
+	repeated := map[ast.Node]bool{}
+	for _, r := range findRepeats(fset, f) {
+		repeated[r.element] = true
+	}
+	var expanded []token.Position
+	for i, decl := range instanceDecls(f) {
+		copies := 1
+		if repeated[decl] {
+			copies = len(t.variadicArgs)
+		}
+		for j := 0; j < copies; j++ {
+			expanded = append(expanded, positions[i])
+		}
+	}
+	return expanded
+}
+
+// expandRepeats copies the elements after each "template repeat"
+// comment in src once for each variadic argument, replacing the
+// placeholders left by markRepeats, and removes the comments.
+//
+// The result needs formatting again.
+func (t *template) expandRepeats(fileName string, src []byte) []byte {
+	fset, f := parseFile(fileName, src)
+	repeats := findRepeats(fset, f)
+	lineStart := func(offset int) int {
+		return bytes.LastIndexByte(src[:offset], '\n') + 1
+	}
+	lineEnd := func(offset int) int {
+		if i := bytes.IndexByte(src[offset:], '\n'); i >= 0 {
+			return offset + i
+		}
+		return len(src)
+	}
+
+	// Work from the bottom up so the offsets stay valid
+	for i := len(repeats) - 1; i >= 0; i-- {
+		r := repeats[i]
+		directive := fset.Position(r.directive.Pos()).Offset
+		from := lineStart(fset.Position(r.element.Pos()).Offset)
+		end := fset.Position(r.element.End()).Offset
+		to := end
+		if r.commas && to < len(src) && src[to] == ',' {
+			to++
+		}
+
+		// Keep a trailing comment with the element but put
+		// anything else after it, eg the ") T {" after the last
+		// parameter, after the copies
+		rest := strings.TrimSpace(string(src[to:lineEnd(to)]))
+		if rest == "" || strings.HasPrefix(rest, "//") {
+			to, rest = lineEnd(to), ""
+		}
+		element := string(src[from:to])
+		if r.commas && to == end {
+			element = string(src[from:end]) + ","
+		}
+
+		var b bytes.Buffer
+		for i, arg := range t.variadicArgs {
+			b.WriteString(t.repeatReplacer(i, arg).Replace(element))
+			b.WriteString("\n")
+		}
+		if rest != "" {
+			b.WriteString(rest)
+			to = lineEnd(to)
+		} else if to < len(src) {
+			to++ // the newline is already written
+		}
+
+		var out bytes.Buffer
+		out.Write(src[:lineStart(directive)])
+		out.Write(src[lineEnd(directive)+1 : from])
+		out.Write(b.Bytes())
+		out.Write(src[to:])
+		src = out.Bytes()
+	}
+	return src
+}
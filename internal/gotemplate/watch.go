@@ -0,0 +1,409 @@
+// Watches templates and the directives which use them, regenerating
+// the instances affected by changes
+
+package gotemplate
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An instantiation being watched
+type watchedInstance struct {
+	source      string           // where it was found, eg "main.go:12"
+	sourceFile  string           // file with the directive or config in
+	templateDir string           // directory of the template package
+	newTemplate func() *template // makes a fresh template to instantiate
+}
+
+// The state of a file when it was last looked at
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watches directories for changes
+type watcher struct {
+	dir       string               // directory the patterns are relative to
+	patterns  []string             // directories to watch, "/..." includes subdirectories
+	instances []*watchedInstance   // the instantiations found
+	configs   map[string]bool      // config files already indexed
+	files     map[string]fileState // files last time we looked
+}
+
+// newWatcher makes a watcher for the directories matching the
+// patterns, eg "./...", relative to dir and indexes them
+func newWatcher(dir string, patterns []string) *watcher {
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	w := &watcher{
+		dir:      dir,
+		patterns: patterns,
+	}
+	w.index()
+	w.files = w.snapshot()
+	return w
+}
+
+// dirs returns the directories matching the patterns
+func (w *watcher) dirs() []string {
+	var dirs []string
+	for _, pattern := range w.patterns {
+		root := filepath.Join(w.dir, filepath.FromSlash(strings.TrimSuffix(pattern, "/...")))
+		if !strings.HasSuffix(pattern, "/...") {
+			dirs = append(dirs, root)
+			continue
+		}
+		_ = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			name := info.Name()
+			if filePath != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, filePath)
+			return nil
+		})
+	}
+	return dirs
+}
+
+// splitGenerateLine splits the command in a go:generate line into
+// words in the same way as go generate does, expanding the
+// environment variables in expand
+func splitGenerateLine(line string, expand func(string) string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return words, nil
+		}
+		end := strings.IndexAny(line, " \t")
+		if line[0] == '"' {
+			end = -1
+			for i := 1; i < len(line); i++ {
+				if line[i] == '\\' {
+					i++
+				} else if line[i] == '"' {
+					end = i + 1
+					break
+				}
+			}
+			if end < 0 {
+				return nil, errors.New("mismatched quoted string")
+			}
+			word, err := strconv.Unquote(line[:end])
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, os.Expand(word, expand))
+		} else {
+			if end < 0 {
+				end = len(line)
+			}
+			words = append(words, os.Expand(line[:end], expand))
+		}
+		line = line[end:]
+	}
+}
+
+// gotemplateArgs returns the arguments to gotemplate if words runs
+// it or nil if not
+func gotemplateArgs(words []string) []string {
+	if len(words) >= 3 && words[0] == "go" && words[1] == "run" {
+		words = words[2:]
+		words[0] = strings.SplitN(words[0], "@", 2)[0]
+	}
+	if len(words) == 0 || path.Base(filepath.ToSlash(words[0])) != "gotemplate" {
+		return nil
+	}
+	return words[1:]
+}
+
+// generateArgs returns the arguments to gotemplate if the
+// go:generate line on line number lineNumber of fileName in package
+// pkgName runs it or nil if not
+func generateArgs(fileName, pkgName string, lineNumber int, line string) ([]string, error) {
+	env := map[string]string{
+		"GOFILE":    filepath.Base(fileName),
+		"GOLINE":    strconv.Itoa(lineNumber),
+		"GOPACKAGE": pkgName,
+		"DOLLAR":    "$",
+	}
+	words, err := splitGenerateLine(strings.TrimPrefix(line, "//go:generate "), func(name string) string {
+		if value, ok := env[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gotemplateArgs(words), nil
+}
+
+// templateDir returns the directory of the template package pkg
+// imported from dir or "" if it can't be found
+func templateDir(pkg, dir string) string {
+	p, err := build.Default.Import(pkg, dir, build.FindOnly)
+	if err != nil {
+		logf("Can't find template %q from %q: %v", pkg, dir, err)
+		return ""
+	}
+	return p.Dir
+}
+
+// addConfig adds the instances in the config file
+func (w *watcher) addConfig(fileName string, o *options) {
+	if w.configs[fileName] {
+		return
+	}
+	w.configs[fileName] = true
+	err := catchFatal(func() {
+		c := readConfig(fileName)
+		configDir := filepath.Dir(fileName)
+		for i := range c.Instances {
+			instance := &c.Instances[i]
+			w.instances = append(w.instances, &watchedInstance{
+				source:      fmt.Sprintf("%s instance %d", fileName, i+1),
+				sourceFile:  fileName,
+				templateDir: templateDir(instance.Template, configDir),
+				newTemplate: func() *template {
+					return instance.newTemplate(configDir, o)
+				},
+			})
+		}
+	})
+	if err != nil {
+		logf("%s: %v", fileName, err)
+	}
+}
+
+// ignoredFlag accepts any value for a flag which doesn't affect the
+// instances
+type ignoredFlag struct{ isBool bool }
+
+// String turns the flag into a string
+func (f ignoredFlag) String() string { return "" }
+
+// Set ignores the value
+func (f ignoredFlag) Set(string) error { return nil }
+
+// IsBoolFlag returns whether the flag doesn't need a value
+func (f ignoredFlag) IsBoolFlag() bool { return f.isBool }
+
+// parseDirectiveFlags parses the flags in the arguments of a
+// gotemplate go:generate directive returning the options and the
+// remaining arguments
+//
+// The global flags, eg -v or -j, are accepted but ignored.
+func parseDirectiveFlags(args []string) (o *options, rest []string, err error) {
+	flags := flag.NewFlagSet("gotemplate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	o = newOptions(flags)
+	commandLine.VisitAll(func(f *flag.Flag) {
+		if flags.Lookup(f.Name) == nil {
+			boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+			flags.Var(ignoredFlag{isBool: ok && boolFlag.IsBoolFlag()}, f.Name, f.Usage)
+		}
+	})
+	err = flags.Parse(args)
+	if err == nil {
+		err = catchFatal(o.check)
+	}
+	return o, flags.Args(), err
+}
+
+// addDirective adds the instances from the arguments of a gotemplate
+// go:generate directive in fileName in the package pkgName
+func (w *watcher) addDirective(source, fileName, pkgName string, args []string) {
+	o, args, err := parseDirectiveFlags(args)
+	if err != nil {
+		logf("%s: %v", source, err)
+		return
+	}
+	dir := filepath.Dir(fileName)
+	switch {
+	case len(args) >= 1 && args[0] == "generate":
+		configFile := ""
+		if len(args) > 1 {
+			configFile = filepath.Join(dir, args[1])
+		} else if configFile = findConfig(dir); configFile == "" {
+			logf("%s: didn't find %s", source, configFileName)
+			return
+		}
+		w.addConfig(configFile, o)
+	case len(args) == 2 && args[0] != "describe":
+		pkg, spec := args[0], args[1]
+		w.instances = append(w.instances, &watchedInstance{
+			source:      source,
+			sourceFile:  fileName,
+			templateDir: templateDir(pkg, dir),
+			newTemplate: func() *template {
+				t := newTemplate(dir, pkg, spec)
+				o.apply(t)
+				t.generatedFrom(fileName, pkgName)
+				return t
+			},
+		})
+	}
+}
+
+// addGoFile adds the instances from the go:generate directives in the
+// go file
+func (w *watcher) addGoFile(fileName string) {
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		logf("Failed to read %q: %v", fileName, err)
+		return
+	}
+	if !strings.Contains(string(src), "//go:generate") {
+		return
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), fileName, src, parser.PackageClauseOnly)
+	if err != nil {
+		logf("Failed to parse %q: %v", fileName, err)
+		return
+	}
+	for i, line := range strings.Split(string(src), "\n") {
+		if !strings.HasPrefix(line, "//go:generate ") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", fileName, i+1)
+		args, err := generateArgs(fileName, f.Name.Name, i+1, line)
+		if err != nil {
+			logf("%s: %v", source, err)
+			continue
+		}
+		if args != nil {
+			w.addDirective(source, fileName, f.Name.Name, args)
+		}
+	}
+}
+
+// index finds all the instantiations in the watched directories
+func (w *watcher) index() {
+	w.instances = nil
+	w.configs = map[string]bool{}
+	for _, dir := range w.dirs() {
+		configFile := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(configFile); err == nil {
+			w.addConfig(configFile, opts)
+		}
+		names, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+		for _, name := range names {
+			w.addGoFile(name)
+		}
+	}
+	debugf("Found %d instantiations", len(w.instances))
+}
+
+// snapshot returns the state of the files which could affect the
+// instantiations
+func (w *watcher) snapshot() map[string]fileState {
+	files := map[string]fileState{}
+	add := func(pattern string) {
+		names, _ := filepath.Glob(pattern)
+		for _, name := range names {
+			if info, err := os.Stat(name); err == nil {
+				files[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+		}
+	}
+	for _, dir := range w.dirs() {
+		add(filepath.Join(dir, "*.go"))
+		add(filepath.Join(dir, configFileName))
+	}
+	for _, instance := range w.instances {
+		if instance.templateDir != "" {
+			add(filepath.Join(instance.templateDir, "*.go"))
+		}
+	}
+	return files
+}
+
+// poll looks for changed files and regenerates the instances they
+// affect, returning the errors which were logged
+func (w *watcher) poll() (errs []error) {
+	files := w.snapshot()
+	changed := map[string]bool{}
+	for name, state := range files {
+		if old, ok := w.files[name]; !ok || old != state {
+			changed[name] = true
+		}
+	}
+	for name := range w.files {
+		if _, ok := files[name]; !ok {
+			changed[name] = true
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// The directives may have changed too
+	w.index()
+
+	var sources []string
+	for name := range changed {
+		sources = append(sources, name)
+	}
+	sort.Strings(sources)
+	debugf("Changed files: %v", sources)
+	for _, instance := range w.instances {
+		if !changed[instance.sourceFile] && !w.templateChanged(instance, changed) {
+			continue
+		}
+		var t *template
+		err := catchFatal(func() {
+			t = instance.newTemplate()
+			t.instantiate()
+		})
+		if err != nil {
+			reportError(instance.source, t, err)
+			errs = append(errs, err)
+		} else {
+			logf("%s: regenerated %s", instance.source, filepath.Join(t.Dir, t.outputFileName()))
+		}
+	}
+
+	// Don't trigger on the files we've just written
+	w.files = w.snapshot()
+	return errs
+}
+
+// templateChanged returns whether any of the changed files are in
+// the template package for instance
+func (w *watcher) templateChanged(instance *watchedInstance, changed map[string]bool) bool {
+	for name := range changed {
+		if instance.templateDir != "" && filepath.Dir(name) == instance.templateDir {
+			return true
+		}
+	}
+	return false
+}
+
+// watch regenerates the instances in the directories matching the
+// patterns whenever they or their templates change
+func watch(dir string, patterns []string, interval time.Duration) {
+	w := newWatcher(dir, patterns)
+	logf("Watching %d instantiations", len(w.instances))
+	for {
+		time.Sleep(interval)
+		w.poll()
+	}
+}
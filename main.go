@@ -24,76 +24,52 @@ do replacements in comments too?
 */
 
 import (
-	"flag"
-	"fmt"
-	"strings"
-
-	"log"
+	"encoding/json"
+	"io/ioutil"
 	"os"
-	"path"
-)
+	"strings"
 
-// Globals
-var (
-	// Flags
-	verbose = flag.Bool("v", false, "Verbose - print lots of stuff")
-	outfile = flag.String("outfmt", "gotemplate_%v", "the format of the output file; must contain a single instance of the %v verb\n"+
-		"\twhich will be replaced with the template instance name")
+	"github.com/ncw/gotemplate/analyzer"
+	"github.com/ncw/gotemplate/internal/gotemplate"
+	"golang.org/x/tools/go/analysis/unitchecker"
 )
 
-// Logging function
-var logf = log.Printf
-
-// Log then fatal error
-var fatalf = func(format string, args ...interface{}) {
-	logf(format, args...)
-	os.Exit(1)
-}
-
-// Log if -v set
-func debugf(format string, args ...interface{}) {
-	if *verbose {
-		logf(format, args...)
+// isVetTool returns whether the arguments are from go vet running
+// gotemplate with -vettool
+//
+// go vet asks for the version with -V=full and the flags with -flags
+// then runs the tool on each package with the config file describing
+// it as the last argument.
+func isVetTool(args []string) bool {
+	if len(args) == 0 {
+		return false
 	}
-}
-
-// usage prints the syntax and exists
-func usage() {
-	BaseName := path.Base(os.Args[0])
-	fmt.Fprintf(os.Stderr,
-		"Syntax: %s [flags] package_name parameter\n\n"+
-			"Flags:\n\n",
-		BaseName)
-	flag.PrintDefaults()
-	fmt.Fprintf(os.Stderr, "\n")
-	os.Exit(1)
-}
-
-func main() {
-	log.SetFlags(0)
-	log.SetPrefix("")
-
-	flag.Usage = usage
-	flag.Parse()
-
-	// verify that *outfile contains exactly one occurrence of the %v verb
-	// and no other occurences of %
-	if c := strings.Replace(*outfile, "%v", "", 1); c == *outfile ||
-		strings.Index(c, "%") != -1 {
-
-		fatalf("Invalid outfile format")
+	if len(args) == 1 && (args[0] == "-V=full" || args[0] == "-flags") {
+		return true
 	}
+	return isVetConfig(args[len(args)-1])
+}
 
-	args := flag.Args()
-	if len(args) != 2 {
-		fatalf("Need 2 arguments, package and parameters")
+// isVetConfig returns whether fileName is the JSON config file go
+// vet passes to a vet tool for each package
+func isVetConfig(fileName string) bool {
+	if !strings.HasSuffix(fileName, ".cfg") {
+		return false
 	}
-
-	cwd, err := os.Getwd()
+	b, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		fatalf("Couldn't get wd: %v", err)
+		return false
+	}
+	var config struct {
+		Compiler   string
+		ImportPath string
 	}
+	return json.Unmarshal(b, &config) == nil && config.Compiler != "" && config.ImportPath != ""
+}
 
-	t := newTemplate(cwd, args[0], args[1])
-	t.instantiate()
+func main() {
+	if isVetTool(os.Args[1:]) {
+		unitchecker.Main(analyzer.Analyzer)
+	}
+	gotemplate.Main()
 }
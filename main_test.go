@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsVetTool(t *testing.T) {
+	dir := t.TempDir()
+	vetConfig := filepath.Join(dir, "vet.cfg")
+	err := ioutil.WriteFile(vetConfig, []byte(`{"ID": "example.com/m", "Compiler": "gc", "Dir": "/m", "ImportPath": "example.com/m", "GoFiles": ["/m/main.go"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfig := filepath.Join(dir, "set.cfg")
+	if err := ioutil.WriteFile(otherConfig, []byte("name = set\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"-V=full"}, true},
+		{[]string{"-flags"}, true},
+		{[]string{vetConfig}, true},
+		{[]string{"-gotemplate", vetConfig}, true},
+		{[]string{"-flags", "input", "intSet(int)"}, false},
+		{[]string{"input", "intSet(int)"}, false},
+		{[]string{"generate", otherConfig}, false},
+		{[]string{"generate", filepath.Join(dir, "missing.cfg")}, false},
+	} {
+		if got := isVetTool(test.args); got != test.want {
+			t.Errorf("isVetTool(%q) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
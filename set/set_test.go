@@ -2,26 +2,22 @@
 package set
 
 import (
-	"sort"
 	"testing"
 )
 
-// Check the set is equal to the literal slice
+// newA makes a different element of the set for each i
+//
+// template generator A
+func newA(i int) A { return A(i) }
+
+// Check the set contains exactly the elements made from b
 func assertEqual(t *testing.T, s *Set, b []int) {
-	a := make([]int, len(s.m))
-	i := 0
-	for elem := range s.m {
-		a[i] = int(elem)
-		i++
-	}
-	sort.Ints(a)
-	sort.Ints(b)
-	if len(a) != len(b) {
-		t.Fatalf("Bad lengths %v vs %v", a, b)
+	if len(s.m) != len(b) {
+		t.Fatalf("Bad lengths %d vs %d", len(s.m), len(b))
 	}
-	for i := range a {
-		if a[i] != b[i] {
-			t.Fatalf("%v != %v", a, b)
+	for _, i := range b {
+		if _, found := s.m[newA(i)]; !found {
+			t.Fatalf("%v not found in set", newA(i))
 		}
 	}
 }
@@ -49,94 +45,94 @@ func TestSetLen(t *testing.T) {
 	if a.Len() != 0 {
 		t.Fatal("length nonzero")
 	}
-	a.Add(1)
+	a.Add(newA(1))
 	if a.Len() != 1 {
 		t.Fatal("length not 1")
 	}
-	a.Discard(1)
+	a.Discard(newA(1))
 	if a.Len() != 0 {
 		t.Fatal("length nonzero")
 	}
 }
 
 func TestSetContains(t *testing.T) {
-	a := NewSet().Add(1)
-	if a.Contains(0) {
+	a := NewSet().Add(newA(1))
+	if a.Contains(newA(0)) {
 		t.Fatal("0 found in set")
 	}
-	if !a.Contains(1) {
+	if !a.Contains(newA(1)) {
 		t.Fatal("1 not found in set")
 	}
-	if a.Contains(2) {
+	if a.Contains(newA(2)) {
 		t.Fatal("2 found in set")
 	}
 }
 
 func TestSetAdd(t *testing.T) {
-	a := NewSet().Add(1).Add(2).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(2)).Add(newA(3))
 	assertEqual(t, a, []int{1, 2, 3})
 }
 
 func TestSetAddList(t *testing.T) {
-	a := NewSet().AddList([]A{1, 2, 3})
+	a := NewSet().AddList([]A{newA(1), newA(2), newA(3)})
 	assertEqual(t, a, []int{1, 2, 3})
 }
 
 func TestSetDiscard(t *testing.T) {
-	a := NewSet().Add(1).Add(3).Discard(1).Discard(2)
+	a := NewSet().Add(newA(1)).Add(newA(3)).Discard(newA(1)).Discard(newA(2))
 	assertEqual(t, a, []int{3})
 }
 
 func TestSetRemove(t *testing.T) {
-	a := NewSet().Add(1).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(3))
 	assertEqual(t, a, []int{1, 3})
-	if a.Remove(1) != true {
+	if a.Remove(newA(1)) != true {
 		t.Fatal("1 not in set")
 	}
-	if a.Remove(2) != false {
+	if a.Remove(newA(2)) != false {
 		t.Fatal("2 in set")
 	}
 	assertEqual(t, a, []int{3})
 }
 
 func TestSetPop(t *testing.T) {
-	a := NewSet().Add(1).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(3))
 	assertEqual(t, a, []int{1, 3})
-	elem, found := a.Pop(1)
-	if elem != 1 || found != true {
+	elem, found := a.Pop(newA(1))
+	if elem != newA(1) || found != true {
 		t.Fatal("pop existing element failed")
 	}
-	elem, found = a.Pop(2)
-	if elem != 2 || found != false {
+	elem, found = a.Pop(newA(2))
+	if elem != newA(2) || found != false {
 		t.Fatal("pop non-existing element failed")
 	}
 	assertEqual(t, a, []int{3})
 }
 
 func TestSetAsList(t *testing.T) {
-	a := NewSet().Add(1).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(3))
 	assertEqual(t, a, []int{1, 3})
 	as := a.AsList()
 	if len(as) != 2 {
 		t.Fatal("length != 2")
 	}
-	if as[1] < as[0] {
+	if as[0] == newA(3) {
 		as[0], as[1] = as[1], as[0]
 	}
-	if as[0] != 1 || as[1] != 3 {
+	if as[0] != newA(1) || as[1] != newA(3) {
 		t.Fatal("set as list failed")
 	}
 }
 
 func TestSetClear(t *testing.T) {
-	a := NewSet().Add(1).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(3))
 	assertEqual(t, a, []int{1, 3})
 	a.Clear()
 	assertEqual(t, a, []int{})
 }
 
 func TestSetCopy(t *testing.T) {
-	a := NewSet().Add(1).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(3))
 	assertEqual(t, a, []int{1, 3})
 	b := a.Copy()
 	assertEqual(t, b, []int{1, 3})
@@ -147,8 +143,8 @@ func TestSetCopy(t *testing.T) {
 
 func TestSetDifference(t *testing.T) {
 	assertEqual(t, NewSet().Difference(NewSet()), []int{})
-	a := NewSet().Add(1).Add(3)
-	b := NewSet().Add(1).Add(2)
+	a := NewSet().Add(newA(1)).Add(newA(3))
+	b := NewSet().Add(newA(1)).Add(newA(2))
 	assertEqual(t, a.Difference(b), []int{3})
 	assertEqual(t, a, []int{1, 3})
 	assertEqual(t, a.Difference(NewSet()), []int{1, 3})
@@ -161,14 +157,14 @@ func TestSetDifference(t *testing.T) {
 
 func TestSetDifferenceUpdate(t *testing.T) {
 	assertEqual(t, NewSet().DifferenceUpdate(NewSet()), []int{})
-	a := NewSet().Add(1).Add(3)
-	b := NewSet().Add(1).Add(2)
+	a := NewSet().Add(newA(1)).Add(newA(3))
+	b := NewSet().Add(newA(1)).Add(newA(2))
 	assertEqual(t, a.DifferenceUpdate(b), []int{3})
 	a.DifferenceUpdate(b)
 	assertEqual(t, a, []int{3})
 	assertEqual(t, a.DifferenceUpdate(NewSet()), []int{3})
 	assertEqual(t, NewSet().DifferenceUpdate(a), []int{})
-	a.Add(1)
+	a.Add(newA(1))
 	assertEqual(t, b.DifferenceUpdate(a), []int{2})
 	assertEqual(t, b, []int{2})
 }
@@ -178,10 +174,10 @@ func TestSetIntersection(t *testing.T) {
 	b := NewSet()
 	assertEqual(t, a.Intersection(b), []int{})
 	assertEqual(t, b.Intersection(a), []int{})
-	a.Add(1)
-	a.Add(2)
-	b.Add(2)
-	b.Add(3)
+	a.Add(newA(1))
+	a.Add(newA(2))
+	b.Add(newA(2))
+	b.Add(newA(3))
 	assertEqual(t, a.Intersection(b), []int{2})
 	assertEqual(t, a, []int{1, 2})
 	assertEqual(t, b.Intersection(a), []int{2})
@@ -193,16 +189,16 @@ func TestSetIntersectionUpdate(t *testing.T) {
 	b := NewSet()
 	assertEqual(t, a.IntersectionUpdate(b), []int{})
 	assertEqual(t, b.IntersectionUpdate(a), []int{})
-	a.Add(1)
-	a.Add(2)
-	b.Add(2)
-	b.Add(3)
+	a.Add(newA(1))
+	a.Add(newA(2))
+	b.Add(newA(2))
+	b.Add(newA(3))
 	assertEqual(t, a.IntersectionUpdate(b), []int{2})
 	assertEqual(t, a, []int{2})
-	a.Add(1)
-	a.Add(2)
-	b.Add(2)
-	b.Add(3)
+	a.Add(newA(1))
+	a.Add(newA(2))
+	b.Add(newA(2))
+	b.Add(newA(3))
 	assertEqual(t, b.IntersectionUpdate(a), []int{2})
 	assertEqual(t, b, []int{2})
 }
@@ -212,14 +208,14 @@ func TestSetUnion(t *testing.T) {
 	b := NewSet()
 	assertEqual(t, a.Union(b), []int{})
 	assertEqual(t, b.Union(a), []int{})
-	a.Add(1)
-	a.Add(2)
-	b.Add(2)
-	b.Add(3)
+	a.Add(newA(1))
+	a.Add(newA(2))
+	b.Add(newA(2))
+	b.Add(newA(3))
 	assertEqual(t, a.Union(b), []int{1, 2, 3})
 	assertEqual(t, a, []int{1, 2})
-	a.Clear().Add(1).Add(2)
-	b.Clear().Add(2).Add(3)
+	a.Clear().Add(newA(1)).Add(newA(2))
+	b.Clear().Add(newA(2)).Add(newA(3))
 	assertEqual(t, b.Union(a), []int{1, 2, 3})
 	assertEqual(t, b, []int{2, 3})
 }
@@ -229,21 +225,21 @@ func TestSetUpdate(t *testing.T) {
 	b := NewSet()
 	assertEqual(t, a.Update(b), []int{})
 	assertEqual(t, b.Update(a), []int{})
-	a.Add(1)
-	a.Add(2)
-	b.Add(2)
-	b.Add(3)
+	a.Add(newA(1))
+	a.Add(newA(2))
+	b.Add(newA(2))
+	b.Add(newA(3))
 	assertEqual(t, a.Update(b), []int{1, 2, 3})
 	assertEqual(t, a, []int{1, 2, 3})
-	a.Clear().Add(1).Add(2)
-	b.Clear().Add(2).Add(3)
+	a.Clear().Add(newA(1)).Add(newA(2))
+	b.Clear().Add(newA(2)).Add(newA(3))
 	assertEqual(t, b.Update(a), []int{1, 2, 3})
 	assertEqual(t, b, []int{1, 2, 3})
 }
 
 func TestSetIsSuperset(t *testing.T) {
-	a := NewSet().Add(1).Add(2).Add(3)
-	b := NewSet().Add(1).Add(2)
+	a := NewSet().Add(newA(1)).Add(newA(2)).Add(newA(3))
+	b := NewSet().Add(newA(1)).Add(newA(2))
 	assertEqual(t, a, []int{1, 2, 3})
 	assertEqual(t, b, []int{1, 2})
 	//test if superset returns correctly with strict true
@@ -255,7 +251,7 @@ func TestSetIsSuperset(t *testing.T) {
 		t.Fatal("non-strict superset failed")
 	}
 
-	b.Add(3)
+	b.Add(newA(3))
 	assertEqual(t, a, []int{1, 2, 3})
 	assertEqual(t, b, []int{1, 2, 3})
 	//test if superset returns correctly with strict true
@@ -269,8 +265,8 @@ func TestSetIsSuperset(t *testing.T) {
 }
 
 func TestSetIsSubset(t *testing.T) {
-	a := NewSet().Add(1).Add(2).Add(3)
-	b := NewSet().Add(1).Add(2)
+	a := NewSet().Add(newA(1)).Add(newA(2)).Add(newA(3))
+	b := NewSet().Add(newA(1)).Add(newA(2))
 	assertEqual(t, a, []int{1, 2, 3})
 	assertEqual(t, b, []int{1, 2})
 	//test if subset returns correctly with strict true
@@ -281,7 +277,7 @@ func TestSetIsSubset(t *testing.T) {
 	if b.IsSubset(false, a) == false {
 		t.Fatal("non-strict subset failed")
 	}
-	b.Add(3)
+	b.Add(newA(3))
 	assertEqual(t, a, []int{1, 2, 3})
 	assertEqual(t, b, []int{1, 2, 3})
 	//test if subset returns correctly with strict true
@@ -295,24 +291,24 @@ func TestSetIsSubset(t *testing.T) {
 }
 
 func TestSetIsDisjoint(t *testing.T) {
-	a := NewSet().Add(1)
-	b := NewSet().Add(2)
+	a := NewSet().Add(newA(1))
+	b := NewSet().Add(newA(2))
 	assertEqual(t, a, []int{1})
 	assertEqual(t, b, []int{2})
 	if a.IsDisjoint(b) == false || b.IsDisjoint(a) == false {
 		t.Fatal("disjoint failed #1")
 	}
 
-	c := NewSet().Add(1).Add(2)
-	d := NewSet().Add(2)
+	c := NewSet().Add(newA(1)).Add(newA(2))
+	d := NewSet().Add(newA(2))
 	assertEqual(t, c, []int{1, 2})
 	assertEqual(t, d, []int{2})
 	if c.IsDisjoint(d) == true || d.IsDisjoint(c) == true {
 		t.Fatal("disjoint failed #2")
 	}
 
-	e := NewSet().Add(1)
-	f := NewSet().Add(1).Add(2)
+	e := NewSet().Add(newA(1))
+	f := NewSet().Add(newA(1)).Add(newA(2))
 	assertEqual(t, e, []int{1})
 	assertEqual(t, f, []int{1, 2})
 	if e.IsDisjoint(f) == true || f.IsDisjoint(e) == true {
@@ -321,8 +317,8 @@ func TestSetIsDisjoint(t *testing.T) {
 }
 
 func TestSetSymmetricDifference(t *testing.T) {
-	a := NewSet().Add(1).Add(2)
-	b := NewSet().Add(2).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(2))
+	b := NewSet().Add(newA(2)).Add(newA(3))
 	c := a.SymmetricDifference(b)
 	assertEqual(t, a, []int{1, 2})
 	assertEqual(t, b, []int{2, 3})
@@ -330,8 +326,8 @@ func TestSetSymmetricDifference(t *testing.T) {
 }
 
 func TestSetSymmetricDifferenceUpdate(t *testing.T) {
-	a := NewSet().Add(1).Add(2)
-	b := NewSet().Add(2).Add(3)
+	a := NewSet().Add(newA(1)).Add(newA(2))
+	b := NewSet().Add(newA(2)).Add(newA(3))
 	assertEqual(t, a, []int{1, 2})
 	assertEqual(t, b, []int{2, 3})
 	a.SymmetricDifferenceUpdate(b)
@@ -9,7 +9,7 @@ func BenchmarkSeqSet(b *testing.B) {
 	tr := New(less)
 	for i := 0; i < b.N; i++ {
 		for j := 0; j < NumIters; j++ {
-			tr.Set(j, "")
+			tr.Set(newKey(j), value(""))
 		}
 		tr.Clear()
 	}
@@ -19,11 +19,11 @@ func BenchmarkSeqSet(b *testing.B) {
 func BenchmarkSeqGet(b *testing.B) {
 	tr := New(less)
 	for i := 0; i < NumIters; i++ {
-		tr.Set(i, "")
+		tr.Set(newKey(i), value(""))
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		tr.Get(i % NumIters)
+		tr.Get(newKey(i % NumIters))
 	}
 	b.ReportAllocs()
 }
@@ -31,7 +31,7 @@ func BenchmarkSeqGet(b *testing.B) {
 func BenchmarkSeqIter(b *testing.B) {
 	tr := New(less)
 	for i := 0; i < NumIters; i++ {
-		tr.Set(i, "")
+		tr.Set(newKey(i), value(""))
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -45,7 +45,7 @@ func benchmarksRandomData() ([]Key, int) {
 	keys := make([]Key, NumIters)
 	max := NumIters * 100
 	for i := range keys {
-		keys[i] = int(rand.Int63n(int64(max)))
+		keys[i] = newKey(int(rand.Int63n(int64(max))))
 	}
 	return keys, max
 }
@@ -56,7 +56,7 @@ func BenchmarkRndSet(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		for _, k := range keys {
-			tr.Set(k, "")
+			tr.Set(k, value(""))
 		}
 		tr.Clear()
 	}
@@ -67,11 +67,11 @@ func BenchmarkRndGet(b *testing.B) {
 	tr := New(less)
 	keys, max := benchmarksRandomData()
 	for _, k := range keys {
-		tr.Set(k, "")
+		tr.Set(k, value(""))
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		tr.Get(i % max)
+		tr.Get(newKey(i % max))
 	}
 	b.ReportAllocs()
 }
@@ -80,7 +80,7 @@ func BenchmarkRndIter(b *testing.B) {
 	tr := New(less)
 	keys, _ := benchmarksRandomData()
 	for _, k := range keys {
-		tr.Set(k, "")
+		tr.Set(k, value(""))
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
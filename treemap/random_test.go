@@ -11,41 +11,35 @@ import (
 const NumIters = 10000
 const RandMax = 40
 
-func min(kv map[Key]Value) Key {
-	if len(kv) == 0 {
-		return nil
-	}
-	var key Key
+// min returns the first key in kv by less and whether there was one
+func min(kv map[Key]Value) (key Key, ok bool) {
 	for k := range kv {
-		if key == nil || k.(int) < key.(int) {
-			key = k
+		if !ok || less(k, key) {
+			key, ok = k, true
 		}
 	}
-	return key
+	return key, ok
 }
 
-func max(kv map[Key]Value) Key {
-	if len(kv) == 0 {
-		return nil
-	}
-	var key Key
+// max returns the last key in kv by less and whether there was one
+func max(kv map[Key]Value) (key Key, ok bool) {
 	for k := range kv {
-		if key == nil || k.(int) > key.(int) {
-			key = k
+		if !ok || less(key, k) {
+			key, ok = k, true
 		}
 	}
-	return key
+	return key, ok
 }
 
 type pair struct {
-	k int
-	v interface{}
+	k Key
+	v Value
 }
 
 func testRandomData() []pair {
 	var kv []pair
 	for i := 0; i < NumIters; i++ {
-		k := int(rand.Int63n(RandMax))
+		k := newKey(int(rand.Int63n(RandMax)))
 		v := value(strconv.Itoa(int(rand.Int63n(RandMax))))
 		kv = append(kv, pair{k, v})
 	}
@@ -53,16 +47,16 @@ func testRandomData() []pair {
 }
 
 func testKeys(t *testing.T, mp map[Key]Value, tr *TreeMap) {
-	var gotKeys []int
+	var gotKeys []Key
 	for it := tr.Iterator(); it.Valid(); it.Next() {
-		gotKeys = append(gotKeys, it.Key().(int))
+		gotKeys = append(gotKeys, it.Key())
 	}
 
-	var expKeys []int
+	var expKeys []Key
 	for k := range mp {
-		expKeys = append(expKeys, k.(int))
+		expKeys = append(expKeys, k)
 	}
-	sort.Ints(expKeys)
+	sort.Slice(expKeys, func(i, j int) bool { return less(expKeys[i], expKeys[j]) })
 
 	if !reflect.DeepEqual(gotKeys, expKeys) {
 		t.Errorf("wrong keys, expected %v, got %v", expKeys, gotKeys)
@@ -70,22 +64,23 @@ func testKeys(t *testing.T, mp map[Key]Value, tr *TreeMap) {
 }
 
 func testMinMax(t *testing.T, mp map[Key]Value, tr *TreeMap) {
-	exp := min(mp)
-	var got Key
+	var none Key
+	exp, expOK := min(mp)
+	got, gotOK := none, false
 	if it := tr.Iterator(); it.Valid() {
-		got = it.Key()
+		got, gotOK = it.Key(), true
 	}
-	if exp != got {
-		t.Errorf("wrong min, expected %d, got %d", exp, got)
+	if exp != got || expOK != gotOK {
+		t.Errorf("wrong min, expected %v, got %v", exp, got)
 	}
 
-	exp = max(mp)
-	got = nil
+	exp, expOK = max(mp)
+	got, gotOK = none, false
 	if it := tr.Reverse(); it.Valid() {
-		got = it.Key()
+		got, gotOK = it.Key(), true
 	}
-	if exp != got {
-		t.Errorf("wrong max, expected %d, got %d", exp, got)
+	if exp != got || expOK != gotOK {
+		t.Errorf("wrong max, expected %v, got %v", exp, got)
 	}
 }
 
@@ -4,8 +4,19 @@ import (
 	"testing"
 )
 
+// newKey makes a different key for each i, ordered by less as i is
+//
+// template generator Key
+func newKey(i int) Key { return i }
+
+// less returns whether key x is before key y
+//
+// template generator Key
 func less(x, y Key) bool { return x.(int) < y.(int) }
 
+// value makes a different value for each x
+//
+// template generator Value
 func value(x string) Value { return Value(x) }
 
 func TestNew(t *testing.T) {
@@ -21,9 +32,9 @@ func TestNew(t *testing.T) {
 func TestSet(t *testing.T) {
 	x := value("x")
 	tr := New(less)
-	tr.Set(0, x)
-	if tr.endNode.left.key != 0 {
-		t.Errorf("wrong key, expected 0, got %d", tr.endNode.left.key)
+	tr.Set(newKey(0), x)
+	if tr.endNode.left.key != newKey(0) {
+		t.Errorf("wrong key, expected %v, got %v", newKey(0), tr.endNode.left.key)
 	}
 	if v := tr.endNode.left.value; v != x {
 		t.Errorf("wrong returned value, expected '%s', got '%s'", x, v)
@@ -35,8 +46,8 @@ func TestSet(t *testing.T) {
 
 func TestDel(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "x")
-	tr.Del(0)
+	tr.Set(newKey(0), value("x"))
+	tr.Del(newKey(0))
 	if tr.Len() != 0 {
 		t.Errorf("wrong count after deletion, expected 0, got %d", tr.Len())
 	}
@@ -48,16 +59,17 @@ func TestDel(t *testing.T) {
 func TestGet(t *testing.T) {
 	x := value("x")
 	tr := New(less)
-	tr.Set(0, x)
-	v, ok := tr.Get(0)
+	tr.Set(newKey(0), x)
+	v, ok := tr.Get(newKey(0))
 	if v != x || !ok {
 		t.Errorf("wrong returned value, expected 'x', got '%s'", v)
 	}
 	if tr.Len() != 1 {
 		t.Errorf("wrong count, expected 1, got %d", tr.Len())
 	}
-	if v, ok := tr.Get(2); v != nil || ok {
-		t.Errorf("wrong returned value, expected nil, got '%v'", v)
+	var none Value
+	if v, ok := tr.Get(newKey(2)); v != none || ok {
+		t.Errorf("wrong returned value, expected %v, got '%v'", none, v)
 	}
 	if tr.Len() != 1 {
 		t.Errorf("wrong count, expected 1, got %d", tr.Len())
@@ -66,12 +78,12 @@ func TestGet(t *testing.T) {
 
 func TestContains(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "x")
-	val := tr.Contains(0)
+	tr.Set(newKey(0), value("x"))
+	val := tr.Contains(newKey(0))
 	if !val {
 		t.Error("existing is not exist")
 	}
-	val = tr.Contains(1)
+	val = tr.Contains(newKey(1))
 	if val {
 		t.Error("not existing is exist")
 	}
@@ -82,19 +94,19 @@ func TestLen(t *testing.T) {
 	if tr.Len() != 0 {
 		t.Errorf("wrong count, expected 0, got %d", tr.Len())
 	}
-	tr.Set(0, "x")
+	tr.Set(newKey(0), value("x"))
 	if tr.Len() != 1 {
 		t.Errorf("wrong count, expected 1, got %d", tr.Len())
 	}
-	tr.Set(1, "x")
+	tr.Set(newKey(1), value("x"))
 	if tr.Len() != 2 {
 		t.Errorf("wrong count, expected 2, got %d", tr.Len())
 	}
-	tr.Del(1)
+	tr.Del(newKey(1))
 	if tr.Len() != 1 {
 		t.Errorf("wrong count, expected 1, got %d", tr.Len())
 	}
-	tr.Del(0)
+	tr.Del(newKey(0))
 	if tr.Len() != 0 {
 		t.Errorf("wrong count, expected 0, got %d", tr.Len())
 	}
@@ -102,9 +114,9 @@ func TestLen(t *testing.T) {
 
 func TestClear(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "x")
-	tr.Set(1, "y")
-	tr.Set(2, "z")
+	tr.Set(newKey(0), value("x"))
+	tr.Set(newKey(1), value("y"))
+	tr.Set(newKey(2), value("z"))
 	tr.Clear()
 	if tr.Len() != 0 {
 		t.Error("count is not zero")
@@ -131,34 +143,34 @@ func testRange(t *testing.T, it, end ForwardIterator, exp []Value) {
 
 func TestRange(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "x")
-	tr.Set(1, "y")
-	tr.Set(2, "z")
-	tr.Set(3, "m")
-	tr.Set(4, "n")
-	it, end := tr.Range(1, 3)
-	testRange(t, it, end, []Value{"y", "z", "m"})
-	it, end = tr.Range(1, 9)
-	testRange(t, it, end, []Value{"y", "z", "m", "n"})
+	tr.Set(newKey(0), value("x"))
+	tr.Set(newKey(1), value("y"))
+	tr.Set(newKey(2), value("z"))
+	tr.Set(newKey(3), value("m"))
+	tr.Set(newKey(4), value("n"))
+	it, end := tr.Range(newKey(1), newKey(3))
+	testRange(t, it, end, []Value{value("y"), value("z"), value("m")})
+	it, end = tr.Range(newKey(1), newKey(9))
+	testRange(t, it, end, []Value{value("y"), value("z"), value("m"), value("n")})
 }
 
 func TestLowerBound(t *testing.T) {
 	tr := New(less)
-	it := tr.LowerBound(0)
+	it := tr.LowerBound(newKey(0))
 	if it.Valid() {
 		t.Error("lower bound should not exists")
 		return
 	}
-	tr.Set(2, "a")
-	tr.Set(4, "b")
-	tr.Set(6, "c")
-	tr.Set(8, "d")
-	tr.Set(10, "e")
-	tr.Set(12, "e")
-	tr.Set(14, "e")
-	tr.Set(16, "e")
-	tr.Set(18, "e")
-	tr.Set(20, "e")
+	tr.Set(newKey(2), value("a"))
+	tr.Set(newKey(4), value("b"))
+	tr.Set(newKey(6), value("c"))
+	tr.Set(newKey(8), value("d"))
+	tr.Set(newKey(10), value("e"))
+	tr.Set(newKey(12), value("e"))
+	tr.Set(newKey(14), value("e"))
+	tr.Set(newKey(16), value("e"))
+	tr.Set(newKey(18), value("e"))
+	tr.Set(newKey(20), value("e"))
 
 	tbl := [][2]int{
 		{0, 2},
@@ -173,18 +185,18 @@ func TestLowerBound(t *testing.T) {
 	}
 
 	for _, tb := range tbl {
-		it = tr.LowerBound(tb[0])
+		it = tr.LowerBound(newKey(tb[0]))
 		if !it.Valid() {
 			t.Error("lower bound should exists")
 			return
 		}
-		if k := it.Key(); k != tb[1] {
+		if k := it.Key(); k != newKey(tb[1]) {
 			t.Errorf("lower bound should be %v", tb[1])
 			return
 		}
 	}
 
-	it = tr.LowerBound(21)
+	it = tr.LowerBound(newKey(21))
 	if it.Valid() {
 		t.Error("lower bound should not exists")
 		return
@@ -193,21 +205,21 @@ func TestLowerBound(t *testing.T) {
 
 func TestUpperBound(t *testing.T) {
 	tr := New(less)
-	it := tr.UpperBound(0)
+	it := tr.UpperBound(newKey(0))
 	if it.Valid() {
 		t.Error("upper bound should not exists")
 		return
 	}
-	tr.Set(2, "a")
-	tr.Set(4, "b")
-	tr.Set(6, "c")
-	tr.Set(8, "d")
-	tr.Set(10, "e")
-	tr.Set(12, "e")
-	tr.Set(14, "e")
-	tr.Set(16, "e")
-	tr.Set(18, "e")
-	tr.Set(20, "e")
+	tr.Set(newKey(2), value("a"))
+	tr.Set(newKey(4), value("b"))
+	tr.Set(newKey(6), value("c"))
+	tr.Set(newKey(8), value("d"))
+	tr.Set(newKey(10), value("e"))
+	tr.Set(newKey(12), value("e"))
+	tr.Set(newKey(14), value("e"))
+	tr.Set(newKey(16), value("e"))
+	tr.Set(newKey(18), value("e"))
+	tr.Set(newKey(20), value("e"))
 
 	tbl := [][2]int{
 		{0, 2},
@@ -221,23 +233,23 @@ func TestUpperBound(t *testing.T) {
 	}
 
 	for _, tb := range tbl {
-		it = tr.UpperBound(tb[0])
+		it = tr.UpperBound(newKey(tb[0]))
 		if !it.Valid() {
 			t.Error("lower bound should exists")
 			return
 		}
-		if k := it.Key(); k != tb[1] {
+		if k := it.Key(); k != newKey(tb[1]) {
 			t.Errorf("upper bound should be %v", tb[1])
 			return
 		}
 	}
 
-	it = tr.UpperBound(20)
+	it = tr.UpperBound(newKey(20))
 	if it.Valid() {
 		t.Error("upper bound should not exists")
 		return
 	}
-	it = tr.UpperBound(21)
+	it = tr.UpperBound(newKey(21))
 	if it.Valid() {
 		t.Error("upper bound should not exists")
 		return
@@ -246,12 +258,12 @@ func TestUpperBound(t *testing.T) {
 
 func TestEmptyRange(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "x")
-	tr.Set(1, "y")
-	tr.Set(2, "z")
-	tr.Set(3, "m")
-	tr.Set(4, "n")
-	if rng, end := tr.Range(5, 10); rng != end {
+	tr.Set(newKey(0), value("x"))
+	tr.Set(newKey(1), value("y"))
+	tr.Set(newKey(2), value("z"))
+	tr.Set(newKey(3), value("m"))
+	tr.Set(newKey(4), value("n"))
+	if rng, end := tr.Range(newKey(5), newKey(10)); rng != end {
 		t.Error("range should be empty")
 	}
 }
@@ -259,8 +271,8 @@ func TestEmptyRange(t *testing.T) {
 func TestDelNil(t *testing.T) {
 	x := "x"
 	tr := New(less)
-	tr.Set(0, value(x))
-	tr.Del(1)
+	tr.Set(newKey(0), value(x))
+	tr.Del(newKey(1))
 	if tr.Len() != 1 {
 		t.Errorf("wrong count after del, expected 1, got %d", tr.Len())
 	}
@@ -271,11 +283,11 @@ func TestIteration(t *testing.T) {
 		key   Key
 		value Value
 	}{
-		{0, "a"},
-		{1, "b"},
-		{2, "c"},
-		{3, "d"},
-		{4, "e"},
+		{newKey(0), value("a")},
+		{newKey(1), value("b")},
+		{newKey(2), value("c")},
+		{newKey(3), value("d")},
+		{newKey(4), value("e")},
 	}
 	tr := New(less)
 	for _, kv := range kvs {
@@ -313,11 +325,11 @@ func TestIteration(t *testing.T) {
 
 func TestOutOfBoundsForwardIterationNext(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "a")
-	tr.Set(1, "b")
-	tr.Set(2, "c")
-	tr.Set(3, "d")
-	tr.Set(4, "e")
+	tr.Set(newKey(0), value("a"))
+	tr.Set(newKey(1), value("b"))
+	tr.Set(newKey(2), value("c"))
+	tr.Set(newKey(3), value("d"))
+	tr.Set(newKey(4), value("e"))
 	it := tr.Iterator()
 	for ; it.Valid(); it.Next() {
 	}
@@ -331,11 +343,11 @@ func TestOutOfBoundsForwardIterationNext(t *testing.T) {
 
 func TestOutOfBoundsForwardIterationPrev(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "a")
-	tr.Set(1, "b")
-	tr.Set(2, "c")
-	tr.Set(3, "d")
-	tr.Set(4, "e")
+	tr.Set(newKey(0), value("a"))
+	tr.Set(newKey(1), value("b"))
+	tr.Set(newKey(2), value("c"))
+	tr.Set(newKey(3), value("d"))
+	tr.Set(newKey(4), value("e"))
 	it := tr.Iterator()
 	defer func() {
 		if r := recover(); r == nil {
@@ -347,11 +359,11 @@ func TestOutOfBoundsForwardIterationPrev(t *testing.T) {
 
 func TestOutOfBoundsReverseIterationNext(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "a")
-	tr.Set(1, "b")
-	tr.Set(2, "c")
-	tr.Set(3, "d")
-	tr.Set(4, "e")
+	tr.Set(newKey(0), value("a"))
+	tr.Set(newKey(1), value("b"))
+	tr.Set(newKey(2), value("c"))
+	tr.Set(newKey(3), value("d"))
+	tr.Set(newKey(4), value("e"))
 	it := tr.Reverse()
 	for ; it.Valid(); it.Next() {
 	}
@@ -365,11 +377,11 @@ func TestOutOfBoundsReverseIterationNext(t *testing.T) {
 
 func TestOutOfBoundsReverseIterationPrev(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "a")
-	tr.Set(1, "b")
-	tr.Set(2, "c")
-	tr.Set(3, "d")
-	tr.Set(4, "e")
+	tr.Set(newKey(0), value("a"))
+	tr.Set(newKey(1), value("b"))
+	tr.Set(newKey(2), value("c"))
+	tr.Set(newKey(3), value("d"))
+	tr.Set(newKey(4), value("e"))
 	it := tr.Reverse()
 	defer func() {
 		if r := recover(); r == nil {
@@ -381,12 +393,12 @@ func TestOutOfBoundsReverseIterationPrev(t *testing.T) {
 
 func TestRangeSingle(t *testing.T) {
 	tr := New(less)
-	tr.Set(0, "a")
-	tr.Set(1, "b")
-	tr.Set(2, "c")
+	tr.Set(newKey(0), value("a"))
+	tr.Set(newKey(1), value("b"))
+	tr.Set(newKey(2), value("c"))
 	visited := false
-	for it, end := tr.Range(1, 1); it != end; it.Next() {
-		if visited || it.Value() != "b" {
+	for it, end := tr.Range(newKey(1), newKey(1)); it != end; it.Next() {
+		if visited || it.Value() != value("b") {
 			t.Error("only single element 'b' should be found")
 		}
 		visited = true